@@ -26,6 +26,93 @@
     (dolist (team teams)
       (message "connect %s" team))))
 
+(defun pyspa-slack-post-message (team channel text &optional thread-ts broadcast format)
+  "Post TEXT to CHANNEL of TEAM.
+When THREAD-TS is given the message is posted into the thread,
+and BROADCAST also sends it to the channel.
+FORMAT is `org' or `markdown' to convert TEXT to slack mrkdwn before posting."
+  (let ((text (if format (pyspa/slack-compose team format text) text)))
+    (if thread-ts
+        (pyspa/slack-post-thread-message team channel text thread-ts broadcast)
+      (pyspa/slack-post-message team channel text))))
+
+(defun pyspa-slack-history (team channel &optional bounds)
+  "Return messages of CHANNEL of TEAM, oldest first.
+BOUNDS is a plist of :oldest, :latest and :limit. The latest :limit
+messages between :oldest and :latest are returned, so with only :oldest
+they are the newest ones, not the ones right after :oldest. To page
+back, pass the :ts of the first message returned as :latest. Without
+BOUNDS the latest `slack.history_limit' messages are returned."
+  (pyspa/slack-history team channel bounds))
+
+(defun pyspa-slack-upload-region (team channel start end &optional comment thread-ts)
+  "Upload the region as a snippet to CHANNEL of TEAM."
+  (let ((filename (if buffer-file-name
+                      (file-name-nondirectory buffer-file-name)
+                    (buffer-name)))
+        (filetype (s-chop-suffix "-mode" (symbol-name major-mode))))
+    (pyspa/slack-upload team channel nil
+                        (list :content (buffer-substring-no-properties start end)
+                              :filename filename
+                              :filetype filetype
+                              :comment comment
+                              :thread-ts thread-ts))))
+
+(defvar pyspa-slack-poll-interval 2
+  "Seconds between polls of the slack event queue.")
+
+(defvar pyspa-slack-event-functions '(pyspa-slack-message-event pyspa-slack-notification-event)
+  "Functions called with each slack event plist.")
+
+(defvar pyspa-slack--poll-timer nil)
+
+(defun pyspa-slack-message-text (msg)
+  "Return the text of MSG followed by the text of its attachments."
+  (mapconcat #'identity
+             (delete "" (cons (plist-get msg :text)
+                              (mapcar (lambda (a) (plist-get a :text))
+                                      (plist-get msg :attachments))))
+             "\n"))
+
+(defun pyspa-slack-message-event (event)
+  (when (eq (plist-get event :type) 'message)
+    (message "[%s] #%s %s: %s"
+             (plist-get event :team)
+             (plist-get event :channel)
+             (plist-get event :user)
+             (pyspa-slack-message-text event))))
+
+(defun pyspa-slack-notification-event (event)
+  "Show a desktop notification for messages matching `slack.rules' with notify."
+  (when (and (eq (plist-get event :type) 'notification)
+             (require 'notifications nil t))
+    (notifications-notify
+     :title (format "[%s] #%s %s"
+                    (plist-get event :team)
+                    (plist-get event :channel)
+                    (plist-get event :user))
+     :body (pyspa-slack-message-text event)
+     :urgency (if (plist-get event :urgent) 'critical 'normal))))
+
+(defun pyspa-slack-poll ()
+  (dolist (event (pyspa/slack-poll-events))
+    (run-hook-with-args 'pyspa-slack-event-functions event)))
+
+(defun pyspa-slack-start (&optional team)
+  (interactive)
+  (pyspa/slack-start team)
+  (unless pyspa-slack--poll-timer
+    (setq pyspa-slack--poll-timer
+          (run-with-timer pyspa-slack-poll-interval pyspa-slack-poll-interval #'pyspa-slack-poll))))
+
+(defun pyspa-slack-stop (&optional team)
+  (interactive)
+  (pyspa/slack-stop team)
+  (unless team
+    (when pyspa-slack--poll-timer
+      (cancel-timer pyspa-slack--poll-timer)
+      (setq pyspa-slack--poll-timer nil))))
+
 (defun pyspa-assistant-ask (arg)
   (interactive "sask: ")
   (let ((res (pyspa/assistant-ask arg t)))
@@ -8,8 +8,9 @@ require (
 	github.com/mopemope/emacs-module-go v0.0.2
 	github.com/pkg/errors v0.9.1
 	github.com/rs/zerolog v1.23.0
-	github.com/slack-go/slack v0.9.4
+	github.com/slack-go/slack v0.12.2
 	github.com/spf13/viper v1.8.1
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/oauth2 v0.0.0-20210810183815-faf39c7919d5
 	google.golang.org/api v0.53.0
 	google.golang.org/genproto v0.0.0-20210811021853-ddbe55d93216
@@ -62,6 +62,8 @@ func initModule(env emacs.Environment) {
 		spk := speech.NewSpeaker(config)
 		// speech
 		env.RegisterFunction("pyspa/speech", spk.Speech, 2, "doc", nil)
+		// speak messages matching slack.rules
+		slack.SetSpeaker(spk)
 	}
 	{
 		// slack
@@ -70,8 +72,66 @@ func initModule(env emacs.Environment) {
 		env.RegisterFunction("pyspa/slack-init", slack.InitSlack, 0, "doc", nil)
 		// slack channels
 		env.RegisterFunction("pyspa/slack-channels", slack.GetChannels, 1, "doc", nil)
+		env.RegisterFunction("pyspa/slack-channel-details", slack.GetChannelDetails, 1, "doc", nil)
 		// slack post-message
 		env.RegisterFunction("pyspa/slack-post-message", slack.PostMessage, 3, "doc", nil)
+		env.RegisterFunction("pyspa/slack-post-thread-message", slack.PostThreadMessage, 5, "doc", nil)
+		// slack update-message
+		env.RegisterFunction("pyspa/slack-update-message", slack.UpdateMessage, 4, "doc", nil)
+		// slack delete-message
+		env.RegisterFunction("pyspa/slack-delete-message", slack.DeleteMessage, 3, "doc", nil)
+		// slack history
+		env.RegisterFunction("pyspa/slack-history", slack.GetHistory, 3, "doc", nil)
+		// slack thread
+		env.RegisterFunction("pyspa/slack-thread", slack.GetThread, 3, "doc", nil)
+		// slack open-dm
+		env.RegisterFunction("pyspa/slack-open-dm", slack.OpenDM, 2, "doc", nil)
+		// slack compose
+		env.RegisterFunction("pyspa/slack-compose", slack.ComposeMessage, 3, "doc", nil)
+		// slack upload
+		env.RegisterFunction("pyspa/slack-upload", slack.UploadFile, 4, "doc", nil)
+		// slack download-file
+		env.RegisterFunction("pyspa/slack-download-file", slack.DownloadFile, 3, "doc", nil)
+		// slack reactions
+		env.RegisterFunction("pyspa/slack-add-reaction", slack.AddReaction, 4, "doc", nil)
+		env.RegisterFunction("pyspa/slack-remove-reaction", slack.RemoveReaction, 4, "doc", nil)
+		env.RegisterFunction("pyspa/slack-reactions", slack.GetReactions, 3, "doc", nil)
+		// slack unreads
+		env.RegisterFunction("pyspa/slack-unreads", slack.GetUnreads, 1, "doc", nil)
+		// slack mark-read
+		env.RegisterFunction("pyspa/slack-mark-read", slack.MarkRead, 3, "doc", nil)
+		// slack search
+		env.RegisterFunction("pyspa/slack-search", slack.SearchMessages, 4, "doc", nil)
+		// slack archive
+		env.RegisterFunction("pyspa/slack-archive-search", slack.ArchiveSearch, 3, "doc", nil)
+		env.RegisterFunction("pyspa/slack-archive-backfill", slack.ArchiveBackfill, 2, "doc", nil)
+		// slack export
+		env.RegisterFunction("pyspa/slack-open-export", slack.OpenExport, 1, "doc", nil)
+		// slack status
+		env.RegisterFunction("pyspa/slack-set-status", slack.SetStatus, 4, "doc", nil)
+		env.RegisterFunction("pyspa/slack-clear-status", slack.ClearStatus, 1, "doc", nil)
+		env.RegisterFunction("pyspa/slack-set-presence", slack.SetPresence, 2, "doc", nil)
+		env.RegisterFunction("pyspa/slack-set-snooze", slack.SetSnooze, 2, "doc", nil)
+		env.RegisterFunction("pyspa/slack-end-snooze", slack.EndSnooze, 1, "doc", nil)
+		// slack channel management
+		env.RegisterFunction("pyspa/slack-joinable-channels", slack.GetJoinableChannels, 1, "doc", nil)
+		env.RegisterFunction("pyspa/slack-join-channel", slack.JoinChannel, 2, "doc", nil)
+		env.RegisterFunction("pyspa/slack-leave-channel", slack.LeaveChannel, 2, "doc", nil)
+		env.RegisterFunction("pyspa/slack-create-channel", slack.CreateChannel, 3, "doc", nil)
+		env.RegisterFunction("pyspa/slack-invite", slack.InviteUsers, 3, "doc", nil)
+		env.RegisterFunction("pyspa/slack-set-topic", slack.SetTopic, 3, "doc", nil)
+		env.RegisterFunction("pyspa/slack-set-purpose", slack.SetPurpose, 3, "doc", nil)
+		// slack users
+		env.RegisterFunction("pyspa/slack-users", slack.GetUsers, 1, "doc", nil)
+		env.RegisterFunction("pyspa/slack-user-info", slack.GetUserInfo, 2, "doc", nil)
+		// slack inbox
+		env.RegisterFunction("pyspa/slack-inbox", slack.GetInbox, 1, "doc", nil)
+		// slack start
+		env.RegisterFunction("pyspa/slack-start", slack.StartSlack, 1, "doc", nil)
+		// slack stop
+		env.RegisterFunction("pyspa/slack-stop", slack.StopSlack, 1, "doc", nil)
+		// slack poll-events
+		env.RegisterFunction("pyspa/slack-poll-events", slack.PollEvents, 0, "doc", nil)
 	}
 
 	{
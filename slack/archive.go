@@ -0,0 +1,401 @@
+package slack
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mopemope/emacs-module-go"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/slack-go/slack"
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+)
+
+// messageArchive stores messages in a bolt database.
+// Messages are kept in a bucket per channel nested in a bucket per team and keyed by ts.
+type messageArchive struct {
+	db *bolt.DB
+}
+
+// archivedMessage is the stored form of a Message.
+type archivedMessage struct {
+	Timestamp       string `json:"ts"`
+	ChannelID       string `json:"channel_id"`
+	Channel         string `json:"channel"`
+	UserID          string `json:"user_id"`
+	User            string `json:"user"`
+	Text            string `json:"text"`
+	ThreadTimestamp string `json:"thread_ts,omitempty"`
+}
+
+// archiveHit is a message found in the archive.
+type archiveHit struct {
+	team    string
+	message *Message
+}
+
+var (
+	archive   *messageArchive
+	archiveMu sync.Mutex
+)
+
+// openArchive opens the archive when slack.archive is enabled.
+func openArchive() (*messageArchive, error) {
+	archiveMu.Lock()
+	defer archiveMu.Unlock()
+	if archive != nil || !viper.GetBool("slack.archive") {
+		return archive, nil
+	}
+	p := viper.GetString("slack.archive_path")
+	if p == "" {
+		dir, err := cacheDir()
+		if err != nil {
+			return nil, err
+		}
+		p = filepath.Join(dir, "archive.db")
+	}
+	a, err := newMessageArchive(p)
+	if err != nil {
+		return nil, err
+	}
+	archive = a
+	return archive, nil
+}
+
+// currentArchive returns the open archive, or nil when it is disabled.
+// RTM and Socket Mode goroutines store messages while openArchive may set it.
+func currentArchive() *messageArchive {
+	archiveMu.Lock()
+	defer archiveMu.Unlock()
+	return archive
+}
+
+func newMessageArchive(p string) (*messageArchive, error) {
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return nil, errors.Wrap(err, "failed create archive dir")
+	}
+	db, err := bolt.Open(p, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed open archive")
+	}
+	return &messageArchive{db: db}, nil
+}
+
+func (a *messageArchive) Close() error {
+	return a.db.Close()
+}
+
+// store saves messages of the channel, replacing messages with the same ts.
+func (a *messageArchive) store(teamName string, channelID string, msgs []*Message) error {
+	if a == nil || len(msgs) == 0 {
+		return nil
+	}
+	return a.db.Update(func(tx *bolt.Tx) error {
+		tb, err := tx.CreateBucketIfNotExists([]byte(teamName))
+		if err != nil {
+			return err
+		}
+		cb, err := tb.CreateBucketIfNotExists([]byte(channelID))
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.timestamp == "" {
+				continue
+			}
+			b, err := json.Marshal(&archivedMessage{
+				Timestamp:       m.timestamp,
+				ChannelID:       channelID,
+				Channel:         m.channel,
+				UserID:          m.userID,
+				User:            m.user,
+				Text:            m.archiveText(),
+				ThreadTimestamp: m.threadTimestamp,
+			})
+			if err != nil {
+				return err
+			}
+			if err := cb.Put([]byte(m.timestamp), b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (a *messageArchive) remove(teamName string, channelID string, ts string) error {
+	if a == nil {
+		return nil
+	}
+	return a.db.Update(func(tx *bolt.Tx) error {
+		cb := channelBucket(tx, teamName, channelID)
+		if cb == nil {
+			return nil
+		}
+		return cb.Delete([]byte(ts))
+	})
+}
+
+// backfillCursor returns the ts of the newest message fetched by Backfill.
+// It is kept apart from archived messages because messages received live
+// may be newer than messages not yet backfilled.
+func (a *messageArchive) backfillCursor(teamName string, channelID string) (string, error) {
+	var ts string
+	err := a.db.View(func(tx *bolt.Tx) error {
+		if tb := tx.Bucket([]byte(teamName)); tb != nil {
+			ts = string(tb.Get(backfillKey(channelID)))
+		}
+		return nil
+	})
+	return ts, err
+}
+
+func (a *messageArchive) setBackfillCursor(teamName string, channelID string, ts string) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		tb, err := tx.CreateBucketIfNotExists([]byte(teamName))
+		if err != nil {
+			return err
+		}
+		return tb.Put(backfillKey(channelID), []byte(ts))
+	})
+}
+
+func backfillKey(channelID string) []byte {
+	return []byte("backfill/" + channelID)
+}
+
+// search returns messages containing all words of the query, newest first.
+// teamName may be empty to search all teams.
+func (a *messageArchive) search(teamName string, query string, limit int) ([]*archiveHit, error) {
+	words := strings.Fields(strings.ToLower(query))
+	var hits []*archiveHit
+	err := a.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(team []byte, tb *bolt.Bucket) error {
+			if teamName != "" && string(team) != teamName {
+				return nil
+			}
+			return tb.ForEach(func(channelID []byte, _ []byte) error {
+				cb := tb.Bucket(channelID)
+				if cb == nil {
+					return nil
+				}
+				return cb.ForEach(func(_ []byte, v []byte) error {
+					var am archivedMessage
+					if err := json.Unmarshal(v, &am); err != nil {
+						return err
+					}
+					if !containsWords(strings.ToLower(am.Text), words) {
+						return nil
+					}
+					hits = append(hits, &archiveHit{team: string(team), message: am.message()})
+					return nil
+				})
+			})
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed search archive")
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		return tsAfter(hits[i].message.timestamp, hits[j].message.timestamp)
+	})
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits, nil
+}
+
+func channelBucket(tx *bolt.Tx, teamName string, channelID string) *bolt.Bucket {
+	tb := tx.Bucket([]byte(teamName))
+	if tb == nil {
+		return nil
+	}
+	return tb.Bucket([]byte(channelID))
+}
+
+func containsWords(text string, words []string) bool {
+	for _, w := range words {
+		if !strings.Contains(text, w) {
+			return false
+		}
+	}
+	return true
+}
+
+func (am *archivedMessage) message() *Message {
+	return &Message{
+		timestamp:       am.Timestamp,
+		channel:         am.Channel,
+		userID:          am.UserID,
+		user:            am.User,
+		text:            am.Text,
+		threadTimestamp: am.ThreadTimestamp,
+	}
+}
+
+// archiveText is the text of the message followed by the text of its attachments.
+func (m *Message) archiveText() string {
+	texts := []string{m.text}
+	for _, a := range m.attachments {
+		texts = append(texts, a.text)
+	}
+	return strings.TrimSpace(strings.Join(texts, "\n"))
+}
+
+// archiveMessages stores messages when the archive is enabled.
+func (t *Team) archiveMessages(channelID string, msgs ...*Message) {
+	if err := currentArchive().store(t.name, channelID, msgs); err != nil {
+		log.Debug().Msgf("failed archive messages: %s", err)
+	}
+}
+
+func (t *Team) unarchiveMessage(channelID string, ts string) {
+	if err := currentArchive().remove(t.name, channelID, ts); err != nil {
+		log.Debug().Msgf("failed remove archived message: %s", err)
+	}
+}
+
+// Backfill archives messages of the channel newer than the ones fetched by the last Backfill.
+// A channel without archived messages gets its latest slack.archive_backfill_limit messages.
+// It returns the number of archived messages.
+func (t *Team) Backfill(c *Channel) (int, error) {
+	if err := t.online(); err != nil {
+		return 0, err
+	}
+	a := currentArchive()
+	if a == nil {
+		return 0, errors.New("archive is disabled")
+	}
+	oldest, err := a.backfillCursor(t.name, c.id)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed read archive")
+	}
+	limit := 0
+	if oldest == "" {
+		limit = viper.GetInt("slack.archive_backfill_limit")
+	}
+
+	n := 0
+	newest := oldest
+	nextCur := ""
+	for {
+		var res *slack.GetConversationHistoryResponse
+		err := t.retry("conversations.history", true, func() error {
+			var err error
+			res, err = t.client.GetConversationHistory(&slack.GetConversationHistoryParameters{
+				ChannelID: c.id,
+				Cursor:    nextCur,
+				Oldest:    oldest,
+				Limit:     historyPageSize,
+			})
+			return err
+		})
+		if err != nil {
+			return n, errors.Wrap(err, "failed get conversation history")
+		}
+		var msgs []*Message
+		for i := range res.Messages {
+			m := t.newMessage(c.id, &res.Messages[i].Msg)
+			if tsAfter(m.timestamp, newest) {
+				newest = m.timestamp
+			}
+			msgs = append(msgs, m)
+		}
+		if err := a.store(t.name, c.id, msgs); err != nil {
+			return n, errors.Wrap(err, "failed archive messages")
+		}
+		n += len(msgs)
+		nextCur = res.ResponseMetaData.NextCursor
+		if !res.HasMore || nextCur == "" || (limit > 0 && n >= limit) {
+			break
+		}
+	}
+	if newest != oldest {
+		if err := a.setBackfillCursor(t.name, c.id, newest); err != nil {
+			return n, errors.Wrap(err, "failed save backfill cursor")
+		}
+	}
+	return n, nil
+}
+
+// backfillChannels backfills channels one by one and reports the result as an event.
+func (t *Team) backfillChannels(chs []*Channel) {
+	total := 0
+	for _, c := range chs {
+		n, err := t.Backfill(c)
+		total += n
+		if err != nil {
+			log.Debug().Msgf("failed backfill %s: %s", c.name, err)
+			events.push(t.newEvent(EventError, fmt.Sprintf("failed backfill %s: %s", c.name, err)))
+			continue
+		}
+		log.Debug().Msgf("backfill %s: %d messages", c.name, n)
+	}
+	events.push(t.newEvent(EventArchiveBackfilled, fmt.Sprintf("archived %d messages of %d channels", total, len(chs))))
+}
+
+func ArchiveBackfill(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	teamName, err := ctx.GoStringArg(0)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	channelName, err := optString(env, ctx.Arg(1))
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	if currentArchive() == nil {
+		return stdlib.Nil(), errors.New("archive is disabled, set slack.archive")
+	}
+	team := GetTeam(teamName)
+	if team == nil {
+		return stdlib.Nil(), errors.Errorf("failed find team %s", teamName)
+	}
+	chs := team.GetChannels()
+	if channelName != "" {
+		c := team.channel(channelName)
+		if c == nil {
+			return stdlib.Nil(), errors.Errorf("failed find channel %s", channelName)
+		}
+		chs = []*Channel{c}
+	}
+	go team.backfillChannels(chs)
+	return stdlib.T(), nil
+}
+
+func ArchiveSearch(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	teamName, err := optString(env, ctx.Arg(0))
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	query, err := ctx.GoStringArg(1)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	limit := optInt(env, ctx.Arg(2), viper.GetInt("slack.history_limit"))
+	a := currentArchive()
+	if a == nil {
+		return stdlib.Nil(), errors.New("archive is disabled, set slack.archive")
+	}
+
+	hits, err := a.search(teamName, query, limit)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	var items []emacs.Value
+	for _, h := range hits {
+		items = append(items, plist(env, append([]interface{}{":team", h.team}, h.message.plistItems(env)...)...))
+	}
+	return stdlib.List(items...), nil
+}
@@ -0,0 +1,377 @@
+package slack
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/slack-go/slack"
+	"github.com/spf13/viper"
+)
+
+// teamCache is the on-disk form of the channels and users of a team.
+type teamCache struct {
+	Name     string         `json:"name"`
+	UserID   string         `json:"user_id"`
+	Channels []channelCache `json:"channels"`
+	Users    []userCache    `json:"users"`
+}
+
+type channelCache struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	IsIM       bool     `json:"is_im,omitempty"`
+	IsMpIM     bool     `json:"is_mpim,omitempty"`
+	IsPrivate  bool     `json:"is_private,omitempty"`
+	UserIDs    []string `json:"user_ids,omitempty"`
+	Topic      string   `json:"topic,omitempty"`
+	Purpose    string   `json:"purpose,omitempty"`
+	NumMembers int      `json:"num_members,omitempty"`
+	Muted      bool     `json:"muted,omitempty"`
+}
+
+type userCache struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Handle      string `json:"handle,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+	RealName    string `json:"real_name,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Email       string `json:"email,omitempty"`
+	TZ          string `json:"tz,omitempty"`
+	TZOffset    int    `json:"tz_offset,omitempty"`
+	IsBot       bool   `json:"is_bot,omitempty"`
+	Deleted     bool   `json:"deleted,omitempty"`
+	Avatar      string `json:"avatar,omitempty"`
+}
+
+func cacheDir() (string, error) {
+	dir := viper.GetString("slack.cache_dir")
+	if dir == "" {
+		base, err := os.UserCacheDir()
+		if err != nil {
+			return "", errors.Wrap(err, "")
+		}
+		dir = filepath.Join(base, "pyspa", "slack")
+	}
+	return dir, nil
+}
+
+// cachePath returns the cache file of the team.
+// The file is keyed by the token because the team name is unknown before connecting.
+func (t *Team) cachePath() (string, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(t.token))
+	return filepath.Join(dir, hex.EncodeToString(sum[:8])+".json"), nil
+}
+
+// loadCache restores the team from the cache file.
+// It returns false when there is no usable cache.
+func (t *Team) loadCache() bool {
+	if !viper.GetBool("slack.cache") {
+		return false
+	}
+	p, err := t.cachePath()
+	if err != nil {
+		log.Debug().Msgf("failed get cache path: %s", err)
+		return false
+	}
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Debug().Msgf("failed read cache %s: %s", p, err)
+		}
+		return false
+	}
+	var cache teamCache
+	if err := json.Unmarshal(b, &cache); err != nil {
+		log.Debug().Msgf("failed decode cache %s: %s", p, err)
+		return false
+	}
+	if cache.Name == "" || cache.UserID == "" {
+		return false
+	}
+
+	t.name = cache.Name
+	t.userID = cache.UserID
+	for _, u := range cache.Users {
+		t.addUser(&User{
+			id:          u.ID,
+			name:        u.Name,
+			handle:      u.Handle,
+			displayName: u.DisplayName,
+			realName:    u.RealName,
+			title:       u.Title,
+			email:       u.Email,
+			tz:          u.TZ,
+			tzOffset:    u.TZOffset,
+			isBot:       u.IsBot,
+			deleted:     u.Deleted,
+			avatar:      u.Avatar,
+		})
+	}
+	var chs []*Channel
+	for _, c := range cache.Channels {
+		chs = append(chs, &Channel{
+			teamName:  t.name,
+			id:        c.ID,
+			name:      c.Name,
+			isIM:      c.IsIM,
+			isMpIM:    c.IsMpIM,
+			isPrivate: c.IsPrivate,
+			userIDs:   c.UserIDs,
+			info: channelInfo{
+				topic:      c.Topic,
+				purpose:    c.Purpose,
+				numMembers: c.NumMembers,
+				muted:      c.Muted,
+			},
+		})
+	}
+	t.setChannels(chs, nil)
+	log.Debug().Msgf("load cache team [%s] %d channels %d users", t.name, len(cache.Channels), len(cache.Users))
+	return true
+}
+
+// saveCache writes the channels and users of the team to the cache file.
+func (t *Team) saveCache() error {
+	if !viper.GetBool("slack.cache") {
+		return nil
+	}
+	p, err := t.cachePath()
+	if err != nil {
+		return err
+	}
+
+	cache := teamCache{
+		Name:   t.name,
+		UserID: t.userID,
+	}
+	for _, c := range t.GetChannels() {
+		info := c.channelInfo()
+		cache.Channels = append(cache.Channels, channelCache{
+			ID:         c.id,
+			Name:       c.name,
+			IsIM:       c.isIM,
+			IsMpIM:     c.isMpIM,
+			IsPrivate:  c.isPrivate,
+			UserIDs:    c.userIDs,
+			Topic:      info.topic,
+			Purpose:    info.purpose,
+			NumMembers: info.numMembers,
+			Muted:      info.muted,
+		})
+	}
+	t.umu.RLock()
+	for _, u := range t.users {
+		cache.Users = append(cache.Users, userCache{
+			ID:          u.id,
+			Name:        u.name,
+			Handle:      u.handle,
+			DisplayName: u.displayName,
+			RealName:    u.realName,
+			Title:       u.title,
+			Email:       u.email,
+			TZ:          u.tz,
+			TZOffset:    u.tzOffset,
+			IsBot:       u.isBot,
+			Deleted:     u.deleted,
+			Avatar:      u.avatar,
+		})
+	}
+	t.umu.RUnlock()
+
+	b, err := json.Marshal(&cache)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	t.cmu.Lock()
+	defer t.cmu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return errors.Wrap(err, "failed create cache dir")
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".cache")
+	if err != nil {
+		return errors.Wrap(err, "failed create tempfile")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed write cache")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "failed write cache")
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return errors.Wrap(err, "failed rename cache")
+	}
+	return nil
+}
+
+// updateCache saves the cache, logging failures because it is called from event handlers.
+func (t *Team) updateCache() {
+	if err := t.saveCache(); err != nil {
+		log.Debug().Msgf("failed save cache team [%s]: %s", t.name, err)
+	}
+}
+
+// refresh fetches users and member channels, replaces the cached ones and saves the cache.
+func (t *Team) refresh() error {
+	users, err := t.getUsers()
+	if err != nil {
+		return errors.Wrap(err, "failed get team users")
+	}
+	for i := range users {
+		u := &users[i]
+		t.addUser(newUser(u))
+		log.Debug().Msgf("find user %s:%s:%s", u.ID, u.Name, u.RealName)
+	}
+
+	known := t.channelIDs()
+	muted := t.mutedChannels()
+	var chs []*Channel
+	nextCur := ""
+	for {
+		var channels []slack.Channel
+		var cursor string
+		err := t.retry("conversations.list", true, func() error {
+			var err error
+			channels, cursor, err = t.client.GetConversations(&slack.GetConversationsParameters{
+				Types:  []string{"public_channel", "private_channel", "im", "mpim"},
+				Limit:  1000,
+				Cursor: nextCur,
+			})
+			return err
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed get team channels")
+		}
+
+		for i := range channels {
+			channel := &channels[i]
+			if channel.IsMember || channel.IsIM || channel.IsMpIM {
+				c, err := t.newChannel(channel)
+				if err != nil {
+					return err
+				}
+				c.info.muted = muted[c.id]
+				chs = append(chs, c)
+				log.Debug().Msgf("find channel %s:%s", c.name, c.id)
+			}
+		}
+		if cursor == "" {
+			break
+		} else {
+			nextCur = cursor
+		}
+		t.progress(fmt.Sprintf("fetched %d channels", len(chs)))
+	}
+	t.setChannels(chs, known)
+	t.updateCache()
+	return nil
+}
+
+// refreshInBackground refreshes the team restored from the cache, or connected
+// without one, and then loads read states. A failure such as a revoked token
+// is reported as an error event.
+func (t *Team) refreshInBackground() {
+	if err := t.refresh(); err != nil {
+		log.Debug().Msgf("failed refresh team [%s]: %s", t.name, err)
+		events.push(t.newEvent(EventError, fmt.Sprintf("failed refresh team: %s", err)))
+		return
+	}
+	t.loadReadStates()
+}
+
+// handleDirectoryEvent applies channel and user changes to the team and the cache.
+// It returns false for other events.
+func (t *Team) handleDirectoryEvent(data interface{}) bool {
+	switch ev := data.(type) {
+	case *slack.ChannelCreatedEvent:
+		// the creator joins the new channel
+		if ev.Channel.Creator != t.userID {
+			return true
+		}
+		ch := &slack.Channel{}
+		ch.ID = ev.Channel.ID
+		ch.Name = ev.Channel.Name
+		t.joinChannel(ch)
+	case *slack.ChannelJoinedEvent:
+		t.joinChannel(&ev.Channel)
+	case *slack.GroupJoinedEvent:
+		t.joinChannel(&ev.Channel)
+	case *slack.IMCreatedEvent:
+		ch := &slack.Channel{}
+		ch.ID = ev.Channel.ID
+		ch.IsIM = true
+		ch.User = ev.User
+		t.joinChannel(ch)
+	case *slack.ChannelLeftEvent:
+		t.leaveChannel(ev.Channel)
+	case *slack.GroupLeftEvent:
+		t.leaveChannel(ev.Channel)
+	case *slack.ChannelRenameEvent:
+		t.renameChannel(ev.Channel.ID, ev.Channel.Name)
+	case *slack.GroupRenameEvent:
+		t.renameChannel(ev.Group.ID, ev.Group.Name)
+	case *slack.UserChangeEvent:
+		t.addUser(newUser(&ev.User))
+		t.updateCache()
+	case *slack.TeamJoinEvent:
+		t.addUser(newUser(&ev.User))
+		t.updateCache()
+	default:
+		return false
+	}
+	return true
+}
+
+func (t *Team) joinChannel(ch *slack.Channel) {
+	if _, err := t.registerChannel(ch); err != nil {
+		log.Debug().Msgf("failed add channel %s: %s", ch.ID, err)
+	}
+}
+
+// registerChannel adds the conversation to the team unless it is known and saves the cache.
+func (t *Team) registerChannel(ch *slack.Channel) (*Channel, error) {
+	if c := t.channelByID(ch.ID); c != nil {
+		return c, nil
+	}
+	c, err := t.newChannel(ch)
+	if err != nil {
+		return nil, err
+	}
+	t.addChannel(c)
+	t.updateCache()
+	return c, nil
+}
+
+func (t *Team) leaveChannel(id string) {
+	if t.removeChannel(id) {
+		t.updateCache()
+	}
+}
+
+// renameChannel replaces the channel with a renamed copy, because the name
+// of a registered channel is read without a lock.
+func (t *Team) renameChannel(id string, name string) {
+	t.chmu.Lock()
+	c, ok := t.channelID[id]
+	if !ok || c.name == name {
+		t.chmu.Unlock()
+		return
+	}
+	t.addChannelLocked(c.renamed(name))
+	t.chmu.Unlock()
+	t.updateCache()
+}
@@ -0,0 +1,415 @@
+package slack
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/mopemope/emacs-module-go"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/slack-go/slack"
+)
+
+func GetJoinableChannels(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	team, err := teamArg(ctx)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	chs, err := team.JoinableChannels()
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	var items []emacs.Value
+	for _, ch := range chs {
+		items = append(items, plist(env,
+			":id", ch.ID,
+			":name", ch.Name,
+			":topic", ch.Topic.Value,
+			":purpose", ch.Purpose.Value,
+			":members", ch.NumMembers,
+		))
+	}
+	return stdlib.List(items...), nil
+}
+
+func JoinChannel(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	team, err := teamArg(ctx)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	name, err := ctx.GoStringArg(1)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	c, err := team.JoinChannel(name)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	return env.String(c.name), nil
+}
+
+func LeaveChannel(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	team, err := teamArg(ctx)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	name, err := ctx.GoStringArg(1)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	if err := team.LeaveChannel(name); err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	return stdlib.T(), nil
+}
+
+func CreateChannel(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	team, err := teamArg(ctx)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	name, err := ctx.GoStringArg(1)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	c, err := team.CreateChannel(name, env.GoBool(ctx.Arg(2)))
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	return env.String(c.name), nil
+}
+
+func InviteUsers(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	team, err := teamArg(ctx)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	channelName, err := ctx.GoStringArg(1)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	users, err := stringList(env, ctx.Arg(2))
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "failed parse users")
+	}
+	if err := team.InviteUsers(channelName, users); err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	return stdlib.T(), nil
+}
+
+func SetTopic(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	return setChannelText(ctx, (*Team).SetTopic)
+}
+
+func SetPurpose(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	return setChannelText(ctx, (*Team).SetPurpose)
+}
+
+func setChannelText(ctx emacs.FunctionCallContext, set func(*Team, string, string) error) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	team, err := teamArg(ctx)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	channelName, err := ctx.GoStringArg(1)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	text, err := optString(env, ctx.Arg(2))
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	if err := set(team, channelName, text); err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	return stdlib.T(), nil
+}
+
+// teamArg returns the team named by the first argument.
+func teamArg(ctx emacs.FunctionCallContext) (*Team, error) {
+	teamName, err := ctx.GoStringArg(0)
+	if err != nil {
+		return nil, err
+	}
+	team := GetTeam(teamName)
+	if team == nil {
+		return nil, errors.Errorf("failed find team %s", teamName)
+	}
+	return team, nil
+}
+
+// JoinableChannels returns public channels the user is not a member of.
+// The list is kept for JoinChannel to resolve names without listing them again.
+func (t *Team) JoinableChannels() ([]slack.Channel, error) {
+	if err := t.online(); err != nil {
+		return nil, err
+	}
+	var res []slack.Channel
+	nextCur := ""
+	for {
+		var channels []slack.Channel
+		var cursor string
+		err := t.retryNow("conversations.list", true, func() error {
+			var err error
+			channels, cursor, err = t.client.GetConversations(&slack.GetConversationsParameters{
+				Types:           []string{"public_channel"},
+				ExcludeArchived: true,
+				Limit:           1000,
+				Cursor:          nextCur,
+			})
+			return err
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed get team channels")
+		}
+		for _, ch := range channels {
+			if !ch.IsMember && t.channelByID(ch.ID) == nil {
+				res = append(res, ch)
+			}
+		}
+		if cursor == "" {
+			break
+		}
+		nextCur = cursor
+	}
+	t.chmu.Lock()
+	t.joinable = res
+	t.chmu.Unlock()
+	return res, nil
+}
+
+// joinableID returns the id of the channel named name, or with the id name,
+// from the list JoinableChannels fetched last.
+func (t *Team) joinableID(name string) string {
+	t.chmu.RLock()
+	defer t.chmu.RUnlock()
+	for _, ch := range t.joinable {
+		if ch.Name == name || ch.ID == name {
+			return ch.ID
+		}
+	}
+	return ""
+}
+
+// JoinChannel joins the public channel and registers it to the team.
+// The channel is looked up in the list JoinableChannels fetched last,
+// which is fetched again only when the channel is not in it.
+func (t *Team) JoinChannel(name string) (*Channel, error) {
+	if c := t.channel(name); c != nil {
+		return c, nil
+	}
+	id := t.joinableID(name)
+	if id == "" {
+		if _, err := t.JoinableChannels(); err != nil {
+			return nil, err
+		}
+		if id = t.joinableID(name); id == "" {
+			return nil, errors.Errorf("failed find joinable channel %s", name)
+		}
+	}
+	var joined *slack.Channel
+	// joining a channel twice does nothing
+	err := t.retryNow("conversations.join", true, func() error {
+		var err error
+		joined, _, _, err = t.client.JoinConversation(id)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed join channel")
+	}
+	return t.registerChannel(joined)
+}
+
+func (t *Team) LeaveChannel(name string) error {
+	if err := t.online(); err != nil {
+		return err
+	}
+	c := t.channel(name)
+	if c == nil {
+		return errors.Errorf("failed find channel %s", name)
+	}
+	if _, err := t.client.LeaveConversation(c.id); err != nil {
+		return errors.Wrap(err, "failed leave channel")
+	}
+	t.leaveChannel(c.id)
+	return nil
+}
+
+// CreateChannel creates a public or private channel and registers it to the team.
+func (t *Team) CreateChannel(name string, private bool) (*Channel, error) {
+	if err := t.online(); err != nil {
+		return nil, err
+	}
+	ch, err := t.client.CreateConversation(slack.CreateConversationParams{
+		ChannelName: name,
+		IsPrivate:   private,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed create channel")
+	}
+	return t.registerChannel(ch)
+}
+
+// InviteUsers invites users by name or id to the channel.
+func (t *Team) InviteUsers(channelName string, userNames []string) error {
+	if err := t.online(); err != nil {
+		return err
+	}
+	c := t.channel(channelName)
+	if c == nil {
+		return errors.Errorf("failed find channel %s", channelName)
+	}
+	var ids []string
+	for _, name := range userNames {
+		u := t.findUser(name)
+		if u == nil {
+			return errors.Errorf("failed find user %s", name)
+		}
+		ids = append(ids, u.id)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	if _, err := t.client.InviteUsersToConversation(c.id, ids...); err != nil {
+		return errors.Wrap(err, "failed invite users")
+	}
+	return nil
+}
+
+func (t *Team) SetTopic(channelName string, topic string) error {
+	if err := t.online(); err != nil {
+		return err
+	}
+	c := t.channel(channelName)
+	if c == nil {
+		return errors.Errorf("failed find channel %s", channelName)
+	}
+	if _, err := t.client.SetTopicOfConversation(c.id, topic); err != nil {
+		return errors.Wrap(err, "failed set topic")
+	}
+	return nil
+}
+
+func (t *Team) SetPurpose(channelName string, purpose string) error {
+	if err := t.online(); err != nil {
+		return err
+	}
+	c := t.channel(channelName)
+	if c == nil {
+		return errors.Errorf("failed find channel %s", channelName)
+	}
+	if _, err := t.client.SetPurposeOfConversation(c.id, purpose); err != nil {
+		return errors.Wrap(err, "failed set purpose")
+	}
+	return nil
+}
+
+// SortedChannels returns the channels ordered by name.
+func (t *Team) SortedChannels() []*Channel {
+	chs := t.GetChannels()
+	sort.Slice(chs, func(i, j int) bool {
+		return chs[i].name < chs[j].name
+	})
+	return chs
+}
+
+func (c *Channel) toPlist(env emacs.Environment) emacs.Value {
+	info := c.channelInfo()
+	read := c.readState()
+	return plist(env,
+		":id", c.id,
+		":name", c.name,
+		":is-private", c.isPrivate,
+		":is-im", c.isIM,
+		":is-mpim", c.isMpIM,
+		":topic", info.topic,
+		":purpose", info.purpose,
+		":members", info.numMembers,
+		":unread-count", read.unreadCount,
+		":latest", read.latest,
+		":muted", info.muted,
+	)
+}
+
+func (c *Channel) channelInfo() channelInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.info
+}
+
+// renamed returns a copy of the channel with the new name and the current state.
+func (c *Channel) renamed(name string) *Channel {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &Channel{
+		teamName:  c.teamName,
+		id:        c.id,
+		name:      name,
+		isIM:      c.isIM,
+		isMpIM:    c.isMpIM,
+		isPrivate: c.isPrivate,
+		userIDs:   c.userIDs,
+		read:      c.read,
+		info:      c.info,
+	}
+}
+
+// updateChannelInfo applies topic, purpose and membership change messages to the channel.
+func (t *Team) updateChannelInfo(ev *slack.MessageEvent) {
+	c := t.channelByID(ev.Channel)
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	switch ev.SubType {
+	case "channel_topic", "group_topic":
+		c.info.topic = ev.Topic
+	case "channel_purpose", "group_purpose":
+		c.info.purpose = ev.Purpose
+	case "channel_join", "group_join":
+		c.info.numMembers++
+	case "channel_leave", "group_leave":
+		if c.info.numMembers > 0 {
+			c.info.numMembers--
+		}
+	}
+	c.mu.Unlock()
+	t.updateCache()
+}
+
+// mutedChannels returns the ids of muted channels from the user preferences.
+// users.prefs.get is not available to every token, so failures are only logged.
+func (t *Team) mutedChannels() map[string]bool {
+	muted := map[string]bool{}
+	var prefs *slack.UserPrefsCarrier
+	err := t.retry("users.prefs.get", true, func() error {
+		var err error
+		prefs, err = t.client.GetUserPrefs()
+		return err
+	})
+	if err != nil {
+		log.Debug().Msgf("failed get user prefs: %s", err)
+		return muted
+	}
+	if prefs.UserPrefs == nil {
+		return muted
+	}
+	for _, id := range strings.Split(prefs.UserPrefs.MutedChannels, ",") {
+		if id != "" {
+			muted[id] = true
+		}
+	}
+	return muted
+}
@@ -0,0 +1,282 @@
+package slack
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/mopemope/emacs-module-go"
+	"github.com/pkg/errors"
+)
+
+// Input formats of ComposeMessage
+const (
+	FormatOrg      = "org"
+	FormatMarkdown = "markdown"
+)
+
+var (
+	composeEscape = strings.NewReplacer(
+		"&", "&amp;",
+		"<", "&lt;",
+		">", "&gt;",
+	)
+
+	orgSrcBegin = regexp.MustCompile(`(?i)^\s*#\+begin_(src|example)\b`)
+	orgSrcEnd   = regexp.MustCompile(`(?i)^\s*#\+end_(src|example)\b`)
+	orgKeyword  = regexp.MustCompile(`^\s*#\+\w+:`)
+	orgHeading  = regexp.MustCompile(`^\*+\s+(.*)$`)
+	mdFence     = regexp.MustCompile("^\\s*```")
+	mdHeading   = regexp.MustCompile(`^#{1,6}\s+(.*)$`)
+	listItem    = regexp.MustCompile(`^(\s*)[-+*]\s+(.*)$`)
+	orgListItem = regexp.MustCompile(`^(\s*)[-+]\s+(.*)$|^(\s+)\*\s+(.*)$`)
+	numberItem  = regexp.MustCompile(`^(\s*)(\d+)[.)]\s+(.*)$`)
+
+	// inline tokens which are not converted further
+	orgAtoms       = regexp.MustCompile(`\[\[([^\]]+)\](?:\[([^\]]+)\])?\]|(^|[\s(])(?:=([^\s=](?:[^=]*[^\s=])?)=|~([^\s~](?:[^~]*[^\s~])?)~)`)
+	mdAtoms        = regexp.MustCompile("`([^`]+)`|\\[([^\\]]+)\\]\\(([^)\\s]+)\\)")
+	channelMention = regexp.MustCompile(`(^|[\s(])#([^\s#.,:;!?)]+)`)
+
+	orgBold   = regexp.MustCompile(`(^|[\s('"{])\*([^\s*](?:[^*]*[^\s*])?)\*([\s\-.,:!?;'")}]|$)`)
+	orgItalic = regexp.MustCompile(`(^|[\s('"{])/([^\s/](?:[^/]*[^\s/])?)/([\s\-.,:!?;'")}]|$)`)
+	orgStrike = regexp.MustCompile(`(^|[\s('"{])\+([^\s+](?:[^+]*[^\s+])?)\+([\s\-.,:!?;'")}]|$)`)
+	mdBold    = regexp.MustCompile(`\*\*(.+?)\*\*|__(.+?)__`)
+	mdItalic  = regexp.MustCompile(`(^|[^\w*])\*([^\s*](?:[^*]*[^\s*])?)\*`)
+	mdStrike  = regexp.MustCompile(`~~(.+?)~~`)
+)
+
+// placeholder markers never appear in composed text
+const (
+	atomMark = "\x00"
+	boldMark = "\x01"
+)
+
+func ComposeMessage(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	teamName, err := ctx.GoStringArg(0)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	formatName, err := symbolName(env, ctx.Arg(1))
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	text, err := ctx.GoStringArg(2)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	team := GetTeam(teamName)
+	if team == nil {
+		return stdlib.Nil(), errors.Errorf("failed find team %s", teamName)
+	}
+	res, err := team.Compose(text, formatName)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	return env.String(res), nil
+}
+
+// Compose converts org or markdown text to slack mrkdwn.
+// @name and #channel are converted to user and channel references.
+func (t *Team) Compose(text string, format string) (string, error) {
+	if format != FormatOrg && format != FormatMarkdown {
+		return "", errors.Errorf("unknown format %s", format)
+	}
+	org := format == FormatOrg
+
+	var out []string
+	inCode := false
+	for _, line := range strings.Split(text, "\n") {
+		if inCode {
+			if (org && orgSrcEnd.MatchString(line)) || (!org && mdFence.MatchString(line)) {
+				out = append(out, "```")
+				inCode = false
+				continue
+			}
+			out = append(out, composeEscape.Replace(line))
+			continue
+		}
+
+		switch {
+		case (org && orgSrcBegin.MatchString(line)) || (!org && mdFence.MatchString(line)):
+			out = append(out, "```")
+			inCode = true
+		case org && orgKeyword.MatchString(line):
+			// drop org keywords like #+TITLE:
+		case org && orgHeading.MatchString(line):
+			m := orgHeading.FindStringSubmatch(line)
+			out = append(out, "*"+t.composeInline(m[1], org)+"*")
+		case !org && mdHeading.MatchString(line):
+			m := mdHeading.FindStringSubmatch(line)
+			out = append(out, "*"+t.composeInline(m[1], org)+"*")
+		case numberItem.MatchString(line):
+			m := numberItem.FindStringSubmatch(line)
+			out = append(out, m[1]+m[2]+". "+t.composeInline(m[3], org))
+		case org && orgListItem.MatchString(line):
+			m := orgListItem.FindStringSubmatch(line)
+			indent, item := m[1], m[2]
+			if m[3] != "" {
+				indent, item = m[3], m[4]
+			}
+			out = append(out, indent+"• "+t.composeInline(item, org))
+		case !org && listItem.MatchString(line):
+			m := listItem.FindStringSubmatch(line)
+			out = append(out, m[1]+"• "+t.composeInline(m[2], org))
+		default:
+			out = append(out, t.composeInline(line, org))
+		}
+	}
+	if inCode {
+		out = append(out, "```")
+	}
+	return strings.Join(out, "\n"), nil
+}
+
+// composeInline converts links, code, mentions and emphasis in a line.
+func (t *Team) composeInline(line string, org bool) string {
+	var atoms []string
+	atom := func(s string) string {
+		atoms = append(atoms, s)
+		return fmt.Sprintf("%s%d%s", atomMark, len(atoms)-1, atomMark)
+	}
+
+	if org {
+		line = replaceSubmatch(orgAtoms, line, func(m []string) string {
+			switch {
+			case m[1] != "" && m[2] != "":
+				return atom("<" + m[1] + "|" + composeEscape.Replace(m[2]) + ">")
+			case m[1] != "":
+				return atom("<" + m[1] + ">")
+			default:
+				// keep the border character matched before the marker
+				return m[3] + atom("`"+composeEscape.Replace(m[4]+m[5])+"`")
+			}
+		})
+	} else {
+		line = replaceSubmatch(mdAtoms, line, func(m []string) string {
+			if m[1] != "" {
+				return atom("`" + composeEscape.Replace(m[1]) + "`")
+			}
+			return atom("<" + m[3] + "|" + composeEscape.Replace(m[2]) + ">")
+		})
+	}
+
+	line = replaceSubmatch(channelMention, line, func(m []string) string {
+		if c := t.channel(m[2]); c != nil {
+			return m[1] + atom("<#"+c.id+">")
+		}
+		return m[0]
+	})
+	line = t.composeUserMentions(line, atom)
+
+	line = composeEscape.Replace(line)
+	if org {
+		line = orgBold.ReplaceAllString(line, "${1}"+boldMark+"${2}"+boldMark+"${3}")
+		line = orgItalic.ReplaceAllString(line, "${1}_${2}_${3}")
+		line = orgStrike.ReplaceAllString(line, "${1}~${2}~${3}")
+	} else {
+		line = mdBold.ReplaceAllString(line, boldMark+"${1}${2}"+boldMark)
+		line = mdItalic.ReplaceAllString(line, "${1}_${2}_")
+		line = mdStrike.ReplaceAllString(line, "~${1}~")
+	}
+	line = strings.ReplaceAll(line, boldMark, "*")
+
+	for i, a := range atoms {
+		line = strings.Replace(line, fmt.Sprintf("%s%d%s", atomMark, i, atomMark), a, 1)
+	}
+	return line
+}
+
+// composeUserMentions converts @name to user references.
+// A user is referred to by any of its names and the longest matching name wins,
+// so names may contain spaces.
+func (t *Team) composeUserMentions(line string, atom func(string) string) string {
+	if !strings.Contains(line, "@") {
+		return line
+	}
+	names := t.userNamesByLength()
+
+	var b strings.Builder
+	for i := 0; i < len(line); {
+		if line[i] == '@' && (i == 0 || strings.ContainsAny(line[i-1:i], " \t(")) {
+			if ref, n := userMentionRef(line[i+1:], names); ref != "" {
+				b.WriteString(atom(ref))
+				i += 1 + n
+				continue
+			}
+		}
+		b.WriteByte(line[i])
+		i++
+	}
+	return b.String()
+}
+
+// userMentionRef returns the reference for the user name at the start of s
+// and the length of the name.
+func userMentionRef(s string, names []userMentionName) (string, int) {
+	for _, special := range []string{"here", "channel", "everyone"} {
+		if hasNamePrefix(s, special) {
+			return "<!" + special + ">", len(special)
+		}
+	}
+	for _, n := range names {
+		if hasNamePrefix(s, n.name) {
+			return "<@" + n.user.id + ">", len(n.name)
+		}
+	}
+	return "", 0
+}
+
+// hasNamePrefix reports whether s starts with name followed by a word boundary.
+func hasNamePrefix(s string, name string) bool {
+	if name == "" || !strings.HasPrefix(s, name) {
+		return false
+	}
+	r, _ := utf8.DecodeRuneInString(s[len(name):])
+	return r == utf8.RuneError || !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_')
+}
+
+// replaceSubmatch is ReplaceAllStringFunc with access to submatches.
+func replaceSubmatch(re *regexp.Regexp, s string, repl func([]string) string) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range re.FindAllStringSubmatchIndex(s, -1) {
+		b.WriteString(s[last:loc[0]])
+		m := make([]string, len(loc)/2)
+		for i := range m {
+			if loc[2*i] >= 0 {
+				m[i] = s[loc[2*i]:loc[2*i+1]]
+			}
+		}
+		b.WriteString(repl(m))
+		last = loc[1]
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// userMentionName is a name a user is mentioned by.
+type userMentionName struct {
+	name string
+	user *User
+}
+
+// userNamesByLength returns the names of all users with the longest name first.
+func (t *Team) userNamesByLength() []userMentionName {
+	t.umu.RLock()
+	defer t.umu.RUnlock()
+	var names []userMentionName
+	for _, u := range t.users {
+		for _, name := range u.names() {
+			names = append(names, userMentionName{name: name, user: u})
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return len(names[i].name) > len(names[j].name)
+	})
+	return names
+}
@@ -0,0 +1,154 @@
+package slack
+
+import (
+	"strings"
+
+	"github.com/mopemope/emacs-module-go"
+	"github.com/pkg/errors"
+	"github.com/slack-go/slack"
+)
+
+// OpenDM opens or creates a direct message with the user and returns its channel name.
+func OpenDM(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	teamName, err := ctx.GoStringArg(0)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	userName, err := ctx.GoStringArg(1)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	team := GetTeam(teamName)
+	if team == nil {
+		return stdlib.Nil(), errors.Errorf("failed find team %s", teamName)
+	}
+	c, err := team.OpenDM(userName)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	return env.String(c.name), nil
+}
+
+func (t *Team) OpenDM(userName string) (*Channel, error) {
+	if err := t.online(); err != nil {
+		return nil, err
+	}
+	user := t.findUser(userName)
+	if user == nil {
+		return nil, errors.Errorf("failed find user %s", userName)
+	}
+	ch, _, _, err := t.client.OpenConversation(&slack.OpenConversationParameters{
+		Users:    []string{user.id},
+		ReturnIM: true,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed open conversation")
+	}
+	if c := t.channelByID(ch.ID); c != nil {
+		return c, nil
+	}
+	if ch.User == "" {
+		ch.User = user.id
+	}
+	ch.IsIM = true
+	c, err := t.newChannel(ch)
+	if err != nil {
+		return nil, err
+	}
+	t.addChannel(c)
+	return c, nil
+}
+
+// findUser returns the user with the id, handle, display name or real name,
+// trimming a leading "@".
+func (t *Team) findUser(name string) *User {
+	name = strings.TrimPrefix(name, "@")
+	t.umu.RLock()
+	defer t.umu.RUnlock()
+	if u, ok := t.users[name]; ok {
+		return u
+	}
+	for _, u := range t.users {
+		for _, n := range u.names() {
+			if n == name {
+				return u
+			}
+		}
+	}
+	return nil
+}
+
+// newChannel converts a conversation to a Channel.
+// Direct messages are named "@user" and group direct messages "@user1,@user2"
+// after the counterpart users.
+func (t *Team) newChannel(ch *slack.Channel) (*Channel, error) {
+	c := &Channel{
+		id:        ch.ID,
+		name:      ch.Name,
+		teamName:  t.name,
+		isIM:      ch.IsIM,
+		isMpIM:    ch.IsMpIM,
+		isPrivate: ch.IsPrivate,
+		info: channelInfo{
+			topic:      ch.Topic.Value,
+			purpose:    ch.Purpose.Value,
+			numMembers: ch.NumMembers,
+		},
+	}
+	switch {
+	case ch.IsIM:
+		c.userIDs = []string{ch.User}
+	case ch.IsMpIM:
+		members := ch.Members
+		if len(members) == 0 {
+			var err error
+			if members, err = t.conversationMembers(ch.ID); err != nil {
+				return nil, err
+			}
+		}
+		for _, id := range members {
+			if id != t.userID {
+				c.userIDs = append(c.userIDs, id)
+			}
+		}
+	default:
+		return c, nil
+	}
+
+	var names []string
+	for _, id := range c.userIDs {
+		names = append(names, "@"+t.userName(id))
+	}
+	c.name = strings.Join(names, ",")
+	return c, nil
+}
+
+func (t *Team) conversationMembers(channelID string) ([]string, error) {
+	var members []string
+	nextCur := ""
+	for {
+		var ids []string
+		var cursor string
+		// it is called for each mpim while connecting
+		err := t.retry("conversations.members", true, func() error {
+			var err error
+			ids, cursor, err = t.client.GetUsersInConversation(&slack.GetUsersInConversationParameters{
+				ChannelID: channelID,
+				Cursor:    nextCur,
+				Limit:     1000,
+			})
+			return err
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed get conversation members")
+		}
+		members = append(members, ids...)
+		if cursor == "" {
+			break
+		}
+		nextCur = cursor
+	}
+	return members, nil
+}
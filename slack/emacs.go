@@ -0,0 +1,142 @@
+package slack
+
+import (
+	"github.com/mopemope/emacs-module-go"
+	"github.com/pkg/errors"
+)
+
+// targetTeams returns the named team, or all connected teams when v is nil.
+// Read-only export teams are not connected.
+func targetTeams(env emacs.Environment, v emacs.Value) ([]*Team, error) {
+	if !env.GoBool(v) {
+		var res []*Team
+		for _, team := range teams {
+			if team.export == nil {
+				res = append(res, team)
+			}
+		}
+		return res, nil
+	}
+	name, err := env.GoString(v)
+	if err != nil {
+		return nil, err
+	}
+	team := GetTeam(name)
+	if team == nil {
+		return nil, errors.Errorf("failed find team %s", name)
+	}
+	return []*Team{team}, nil
+}
+
+// plist builds a property list from alternating keywords and values.
+func plist(env emacs.Environment, kvs ...interface{}) emacs.Value {
+	stdlib := env.StdLib()
+	var items []emacs.Value
+	for i := 0; i+1 < len(kvs); i += 2 {
+		key, _ := kvs[i].(string)
+		items = append(items, stdlib.Intern(key), toValue(env, kvs[i+1]))
+	}
+	return stdlib.List(items...)
+}
+
+func toValue(env emacs.Environment, v interface{}) emacs.Value {
+	switch v := v.(type) {
+	case emacs.Value:
+		return v
+	case string:
+		return env.String(v)
+	case int:
+		return env.Int(int64(v))
+	case int64:
+		return env.Int(v)
+	case float64:
+		return env.Float(v)
+	case bool:
+		return env.Bool(v)
+	default:
+		return env.StdLib().Nil()
+	}
+}
+
+// plistGet returns the value of key in the property list, or nil.
+func plistGet(env emacs.Environment, lst emacs.Value, key string) (emacs.Value, error) {
+	stdlib := env.StdLib()
+	if !env.GoBool(lst) {
+		return stdlib.Nil(), nil
+	}
+	return stdlib.Funcall(stdlib.Intern("plist-get"), lst, stdlib.Intern(key))
+}
+
+// optString converts a string or number to a go string. nil becomes "".
+func optString(env emacs.Environment, v emacs.Value) (string, error) {
+	stdlib := env.StdLib()
+	if !env.GoBool(v) {
+		return "", nil
+	}
+	isString, err := stdlib.Funcall(stdlib.Intern("stringp"), v)
+	if err != nil {
+		return "", err
+	}
+	if !env.GoBool(isString) {
+		if v, err = stdlib.Funcall(stdlib.Intern("number-to-string"), v); err != nil {
+			return "", err
+		}
+	}
+	return env.GoString(v)
+}
+
+// symbolName converts a symbol or string to a go string.
+func symbolName(env emacs.Environment, v emacs.Value) (string, error) {
+	stdlib := env.StdLib()
+	s, err := stdlib.Funcall(stdlib.Intern("format"), env.String("%s"), v)
+	if err != nil {
+		return "", err
+	}
+	return env.GoString(s)
+}
+
+// optInt converts an integer to a go int. nil becomes def.
+func optInt(env emacs.Environment, v emacs.Value, def int) int {
+	if !env.GoBool(v) {
+		return def
+	}
+	return int(env.GoInt(v))
+}
+
+// stringList converts a string or a list of strings to a go slice.
+func stringList(env emacs.Environment, lst emacs.Value) ([]string, error) {
+	stdlib := env.StdLib()
+	if !env.GoBool(lst) {
+		return nil, nil
+	}
+	isString, err := stdlib.Funcall(stdlib.Intern("stringp"), lst)
+	if err != nil {
+		return nil, err
+	}
+	if env.GoBool(isString) {
+		s, err := env.GoString(lst)
+		if err != nil {
+			return nil, err
+		}
+		return []string{s}, nil
+	}
+
+	var res []string
+	car := stdlib.Intern("car")
+	cdr := stdlib.Intern("cdr")
+	for env.GoBool(lst) {
+		elem, err := stdlib.Funcall(car, lst)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed call car")
+		}
+		s, err := env.GoString(elem)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+		if lst, err = stdlib.Funcall(cdr, lst); err != nil {
+			return nil, errors.Wrap(err, "failed call cdr")
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,215 @@
+package slack
+
+import (
+	"sync"
+
+	"github.com/mopemope/emacs-module-go"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// RTM event types passed to RTMCallback
+const (
+	EventHello = iota
+	EventConnected
+	EventMessage
+	EventPresenceChange
+	EventLatencyReport
+	EventDesktopNotification
+	EventError
+	EventInvalidAuth
+	EventReactionAdded
+	EventReactionRemoved
+	EventMessageChanged
+	EventMessageDeleted
+	EventArchiveBackfilled
+	EventDNDUpdated
+	EventNotification
+	EventProgress
+)
+
+var eventTypeNames = map[int]string{
+	EventHello:               "hello",
+	EventConnected:           "connected",
+	EventMessage:             "message",
+	EventPresenceChange:      "presence-change",
+	EventLatencyReport:       "latency-report",
+	EventDesktopNotification: "desktop-notification",
+	EventError:               "error",
+	EventInvalidAuth:         "invalid-auth",
+	EventReactionAdded:       "reaction-added",
+	EventReactionRemoved:     "reaction-removed",
+	EventMessageChanged:      "message-changed",
+	EventMessageDeleted:      "message-deleted",
+	EventArchiveBackfilled:   "archive-backfilled",
+	EventDNDUpdated:          "dnd-updated",
+	EventNotification:        "notification",
+	EventProgress:            "progress",
+}
+
+var events *eventQueue
+
+// Event is an event passed to RTMCallback.
+// message is set for message events and reaction for reaction events,
+// otherwise text describes the event. Notification events have both
+// the message and the names of the matched rules in text.
+type Event struct {
+	eventType int
+	teamName  string
+	text      string
+	message   *Message
+	reaction  *reactionEvent
+	presence  *presenceEvent
+	dnd       *dndEvent
+}
+
+func (t *Team) newEvent(eventType int, text string) *Event {
+	return &Event{
+		eventType: eventType,
+		teamName:  t.name,
+		text:      text,
+	}
+}
+
+// eventQueue buffers RTM events until emacs polls them.
+// When the queue is full the oldest event is dropped.
+type eventQueue struct {
+	mu      sync.Mutex
+	events  []*Event
+	size    int
+	dropped int
+}
+
+func newEventQueue(size int) *eventQueue {
+	return &eventQueue{
+		size: size,
+	}
+}
+
+func (q *eventQueue) setSize(size int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.size = size
+}
+
+func (q *eventQueue) push(ev *Event) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.size > 0 && len(q.events) >= q.size {
+		q.events = q.events[1:]
+		q.dropped++
+	}
+	q.events = append(q.events, ev)
+}
+
+func (q *eventQueue) drain() []*Event {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	evs := q.events
+	q.events = nil
+	if q.dropped > 0 {
+		log.Debug().Msgf("dropped %d slack events", q.dropped)
+		q.dropped = 0
+	}
+	return evs
+}
+
+func queueCallback() RTMCallback {
+	return events.push
+}
+
+func StartSlack(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	targets, err := targetTeams(env, ctx.Arg(0))
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+
+	var items []emacs.Value
+	for _, team := range targets {
+		if team.export != nil {
+			continue
+		}
+		ctx, ok := team.begin()
+		if !ok {
+			continue
+		}
+		go team.Start(ctx, queueCallback())
+		items = append(items, env.String(team.name))
+	}
+	return stdlib.List(items...), nil
+}
+
+func StopSlack(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	targets, err := targetTeams(env, ctx.Arg(0))
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+
+	var items []emacs.Value
+	for _, team := range targets {
+		if !team.running() {
+			continue
+		}
+		if err := team.Stop(); err != nil {
+			return stdlib.Nil(), errors.Wrap(err, "failed stop slack")
+		}
+		items = append(items, env.String(team.name))
+	}
+	return stdlib.List(items...), nil
+}
+
+func PollEvents(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+
+	var items []emacs.Value
+	for _, ev := range events.drain() {
+		items = append(items, ev.toPlist(env))
+	}
+	return stdlib.List(items...), nil
+}
+
+func (e *Event) toPlist(env emacs.Environment) emacs.Value {
+	stdlib := env.StdLib()
+	kvs := []interface{}{
+		":type", stdlib.Intern(eventTypeNames[e.eventType]),
+		":team", e.teamName,
+	}
+	switch {
+	case e.message != nil:
+		if e.eventType == EventNotification {
+			kvs = append(kvs, ":rules", e.text)
+		}
+		kvs = append(kvs, e.message.plistItems(env)...)
+	case e.presence != nil:
+		kvs = append(kvs,
+			":user-id", e.presence.userID,
+			":user", e.presence.user,
+			":presence", e.presence.presence,
+		)
+	case e.dnd != nil:
+		kvs = append(kvs,
+			":user-id", e.dnd.userID,
+			":user", e.dnd.user,
+			":dnd-enabled", e.dnd.enabled,
+			":snooze-enabled", e.dnd.snoozeEnabled,
+			":snooze-end", e.dnd.snoozeEnd,
+		)
+	case e.reaction != nil:
+		kvs = append(kvs,
+			":channel", e.reaction.channel,
+			":ts", e.reaction.timestamp,
+			":user", e.reaction.user,
+			":reaction", e.reaction.name,
+		)
+	default:
+		kvs = append(kvs, ":text", e.text)
+	}
+	return plist(env, kvs...)
+}
@@ -0,0 +1,260 @@
+package slack
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mopemope/emacs-module-go"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/slack-go/slack"
+	"github.com/spf13/viper"
+)
+
+// exportArchive is a workspace export zip which backs a read-only team.
+// The zip has users.json, channels.json, groups.json, dms.json and mpims.json,
+// and a directory per conversation with a JSON file of messages per day.
+type exportArchive struct {
+	path  string
+	files map[string]*zip.File
+	// directory of each conversation by channel id
+	dirs map[string]string
+}
+
+// exportConversation is an entry of the conversation lists of an export.
+type exportConversation struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+func OpenExport(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	p, err := ctx.GoStringArg(0)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	team, err := openExport(p)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	return env.String(team.name), nil
+}
+
+// openExports opens the export zips of slack.exports.
+func openExports() ([]*Team, error) {
+	var res []*Team
+	for _, p := range viper.GetStringSlice("slack.exports") {
+		team, err := openExport(p)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, team)
+	}
+	return res, nil
+}
+
+// openExport registers a read-only team named after the zip file.
+func openExport(p string) (*Team, error) {
+	name := strings.TrimSuffix(filepath.Base(p), filepath.Ext(p))
+	if team := GetTeam(name); team != nil {
+		if team.export != nil && team.export.path == p {
+			return team, nil
+		}
+		return nil, errors.Errorf("team %s already exists", name)
+	}
+
+	zr, err := zip.OpenReader(p)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed open export")
+	}
+	team, err := newExportTeam(name, p, zr)
+	if err != nil {
+		zr.Close()
+		return nil, err
+	}
+	teams[name] = team
+	log.Debug().Msgf("open export team [%s] %d channels %d users", name, len(team.channels), len(team.users))
+	return team, nil
+}
+
+// newExportTeam reads the users and conversations of the zip.
+// The zip is kept open to read messages.
+func newExportTeam(name string, p string, zr *zip.ReadCloser) (*Team, error) {
+	export := &exportArchive{
+		path:  p,
+		files: map[string]*zip.File{},
+		dirs:  map[string]string{},
+	}
+	for _, f := range zr.File {
+		export.files[f.Name] = f
+	}
+	team := &Team{
+		name:      name,
+		channels:  map[string]*Channel{},
+		channelID: map[string]*Channel{},
+		users:     map[string]*User{},
+		export:    export,
+	}
+
+	var users []slack.User
+	if err := export.readJSON("users.json", &users); err != nil {
+		return nil, err
+	}
+	for i := range users {
+		team.addUser(newUser(&users[i]))
+	}
+
+	lists := []struct {
+		file      string
+		isIM      bool
+		isMpIM    bool
+		isPrivate bool
+	}{
+		{"channels.json", false, false, false},
+		{"groups.json", false, false, true},
+		{"dms.json", true, false, true},
+		{"mpims.json", false, true, true},
+	}
+	for _, l := range lists {
+		var convs []exportConversation
+		if err := export.readJSON(l.file, &convs); err != nil {
+			return nil, err
+		}
+		for _, conv := range convs {
+			c := team.newExportChannel(&conv, l.isIM, l.isMpIM)
+			c.isPrivate = l.isPrivate
+			team.addChannel(c)
+			export.dirs[c.id] = conv.Name
+			if l.isIM {
+				// direct messages have no name and are stored by id
+				export.dirs[c.id] = conv.ID
+			}
+		}
+	}
+
+	return team, nil
+}
+
+// newExportChannel names direct messages after all members
+// because an export has no user to exclude.
+func (t *Team) newExportChannel(conv *exportConversation, isIM bool, isMpIM bool) *Channel {
+	c := &Channel{
+		teamName: t.name,
+		id:       conv.ID,
+		name:     conv.Name,
+		isIM:     isIM,
+		isMpIM:   isMpIM,
+	}
+	if isIM || isMpIM {
+		c.userIDs = conv.Members
+		var names []string
+		for _, id := range conv.Members {
+			names = append(names, "@"+t.userName(id))
+		}
+		c.name = strings.Join(names, ",")
+	}
+	return c
+}
+
+// readJSON decodes a file of the zip. A missing file is left as is.
+func (e *exportArchive) readJSON(name string, v interface{}) error {
+	f, ok := e.files[name]
+	if !ok {
+		return nil
+	}
+	r, err := f.Open()
+	if err != nil {
+		return errors.Wrapf(err, "failed open %s", name)
+	}
+	defer r.Close()
+	if err := json.NewDecoder(r).Decode(v); err != nil {
+		return errors.Wrapf(err, "failed decode %s", name)
+	}
+	return nil
+}
+
+// messages returns all messages of the conversation, oldest first.
+func (e *exportArchive) messages(channelID string) ([]slack.Msg, error) {
+	dir, ok := e.dirs[channelID]
+	if !ok {
+		return nil, nil
+	}
+	var names []string
+	for name := range e.files {
+		if path.Dir(name) == dir && path.Ext(name) == ".json" {
+			names = append(names, name)
+		}
+	}
+	// files are named by date
+	sort.Strings(names)
+
+	var msgs []slack.Msg
+	for _, name := range names {
+		var day []slack.Msg
+		if err := e.readJSON(name, &day); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, day...)
+	}
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return tsAfter(msgs[j].Timestamp, msgs[i].Timestamp)
+	})
+	return msgs, nil
+}
+
+// exportHistory returns the latest limit messages between oldest and latest
+// excluding thread replies like conversations.history.
+func (t *Team) exportHistory(c *Channel, params *HistoryParameters, limit int) ([]*Message, error) {
+	all, err := t.export.messages(c.id)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []*Message
+	for i := range all {
+		m := &all[i]
+		if params.Oldest != "" && !tsAfter(m.Timestamp, params.Oldest) {
+			continue
+		}
+		if params.Latest != "" && !tsAfter(params.Latest, m.Timestamp) {
+			continue
+		}
+		if m.ThreadTimestamp != "" && m.ThreadTimestamp != m.Timestamp && m.SubType != "thread_broadcast" {
+			continue
+		}
+		msgs = append(msgs, t.newMessage(c.id, m))
+	}
+	if len(msgs) > limit {
+		msgs = msgs[len(msgs)-limit:]
+	}
+	return msgs, nil
+}
+
+// exportReplies returns the parent message and the replies of the thread.
+func (t *Team) exportReplies(c *Channel, threadTS string) ([]*Message, error) {
+	all, err := t.export.messages(c.id)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []*Message
+	for i := range all {
+		m := &all[i]
+		if m.Timestamp == threadTS || m.ThreadTimestamp == threadTS {
+			msgs = append(msgs, t.newMessage(c.id, m))
+		}
+	}
+	return msgs, nil
+}
+
+// online returns an error for teams which have no connection to slack.
+func (t *Team) online() error {
+	if t.export != nil {
+		return errors.Errorf("team %s is a read-only export", t.name)
+	}
+	return nil
+}
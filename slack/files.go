@@ -0,0 +1,328 @@
+package slack
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mopemope/emacs-module-go"
+	"github.com/pkg/errors"
+	"github.com/slack-go/slack"
+	"github.com/spf13/viper"
+)
+
+type FileUploadParameters struct {
+	// File is a path to upload. Content is used when File is empty.
+	File            string
+	Content         string
+	Filename        string
+	Filetype        string
+	Title           string
+	InitialComment  string
+	ThreadTimestamp string
+	Channels        []string
+}
+
+type uploadURLResponse struct {
+	slack.SlackResponse
+	UploadURL string `json:"upload_url"`
+	FileID    string `json:"file_id"`
+}
+
+type completeUploadResponse struct {
+	slack.SlackResponse
+	Files []struct {
+		ID    string `json:"id"`
+		Title string `json:"title"`
+	} `json:"files"`
+}
+
+func UploadFile(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	teamName, err := ctx.GoStringArg(0)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	channels, err := stringList(env, ctx.Arg(1))
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "failed parse channels")
+	}
+	file, err := optString(env, ctx.Arg(2))
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	params, err := fileUploadParameters(env, ctx.Arg(3))
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "failed parse upload parameters")
+	}
+	params.File = file
+	params.Channels = channels
+
+	team := GetTeam(teamName)
+	if team == nil {
+		return stdlib.Nil(), errors.Errorf("failed find team %s", teamName)
+	}
+	id, err := team.UploadFile(params)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	return env.String(id), nil
+}
+
+// fileUploadParameters reads (:content :filename :filetype :title :comment :thread-ts) from a property list.
+func fileUploadParameters(env emacs.Environment, lst emacs.Value) (*FileUploadParameters, error) {
+	params := &FileUploadParameters{}
+	fields := []struct {
+		key string
+		dst *string
+	}{
+		{":content", &params.Content},
+		{":filename", &params.Filename},
+		{":filetype", &params.Filetype},
+		{":title", &params.Title},
+		{":comment", &params.InitialComment},
+		{":thread-ts", &params.ThreadTimestamp},
+	}
+	for _, f := range fields {
+		v, err := plistGet(env, lst, f.key)
+		if err != nil {
+			return nil, err
+		}
+		if *f.dst, err = optString(env, v); err != nil {
+			return nil, err
+		}
+	}
+	return params, nil
+}
+
+// UploadFile uploads a file or content to the channels with
+// files.getUploadURLExternal and files.completeUploadExternal.
+// It returns the id of the uploaded file.
+func (t *Team) UploadFile(params *FileUploadParameters) (string, error) {
+	if params.ThreadTimestamp != "" && len(params.Channels) > 1 {
+		return "", errors.New("thread-ts needs exactly one channel")
+	}
+	var channelIDs []string
+	for _, name := range params.Channels {
+		c := t.channel(name)
+		if c == nil {
+			return "", errors.Errorf("failed find channel %s", name)
+		}
+		channelIDs = append(channelIDs, c.id)
+	}
+
+	data := []byte(params.Content)
+	filename := params.Filename
+	if params.File != "" {
+		b, err := ioutil.ReadFile(params.File)
+		if err != nil {
+			return "", errors.Wrap(err, "failed read file")
+		}
+		data = b
+		if filename == "" {
+			filename = filepath.Base(params.File)
+		}
+	}
+	if filename == "" {
+		return "", errors.New("filename is required to upload content")
+	}
+	title := params.Title
+	if title == "" {
+		title = filename
+	}
+
+	values := url.Values{
+		"filename": {filename},
+		"length":   {strconv.Itoa(len(data))},
+	}
+	if params.Filetype != "" {
+		values.Set("snippet_type", params.Filetype)
+	}
+	var upload uploadURLResponse
+	if err := t.apiCall("files.getUploadURLExternal", values, &upload); err != nil {
+		return "", errors.Wrap(err, "failed get upload url")
+	}
+
+	if err := postUpload(upload.UploadURL, filename, data); err != nil {
+		return "", err
+	}
+
+	files, err := json.Marshal([]map[string]string{{"id": upload.FileID, "title": title}})
+	if err != nil {
+		return "", errors.Wrap(err, "")
+	}
+	values = url.Values{
+		"files": {string(files)},
+	}
+	switch len(channelIDs) {
+	case 0:
+	case 1:
+		values.Set("channel_id", channelIDs[0])
+	default:
+		values.Set("channels", strings.Join(channelIDs, ","))
+	}
+	if params.InitialComment != "" {
+		values.Set("initial_comment", params.InitialComment)
+	}
+	if params.ThreadTimestamp != "" {
+		values.Set("thread_ts", params.ThreadTimestamp)
+	}
+	var complete completeUploadResponse
+	if err := t.apiCall("files.completeUploadExternal", values, &complete); err != nil {
+		return "", errors.Wrap(err, "failed complete upload")
+	}
+	return upload.FileID, nil
+}
+
+func DownloadFile(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	teamName, err := ctx.GoStringArg(0)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	fileURL, err := ctx.GoStringArg(1)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	name, err := optString(env, ctx.Arg(2))
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	team := GetTeam(teamName)
+	if team == nil {
+		return stdlib.Nil(), errors.Errorf("failed find team %s", teamName)
+	}
+	dst, err := team.DownloadFile(fileURL, name)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	stdlib.Message(fmt.Sprintf("downloaded %s", dst))
+	return env.String(dst), nil
+}
+
+// DownloadFile streams url_private of a file to slack.download_dir and returns the path.
+// An existing file is never overwritten.
+func (t *Team) DownloadFile(fileURL string, name string) (string, error) {
+	if err := t.online(); err != nil {
+		return "", err
+	}
+	dir, err := downloadDir()
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		u, err := url.Parse(fileURL)
+		if err != nil {
+			return "", errors.Wrap(err, "failed parse url")
+		}
+		name = path.Base(u.Path)
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".slack-download")
+	if err != nil {
+		return "", errors.Wrap(err, "failed create tempfile")
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := t.client.GetFile(fileURL, tmp); err != nil {
+		tmp.Close()
+		return "", errors.Wrap(err, "failed download file")
+	}
+	if err := tmp.Close(); err != nil {
+		return "", errors.Wrap(err, "failed write file")
+	}
+
+	dst := uniquePath(filepath.Join(dir, filepath.Base(name)))
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return "", errors.Wrap(err, "failed rename file")
+	}
+	return dst, nil
+}
+
+func downloadDir() (string, error) {
+	dir := viper.GetString("slack.download_dir")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", errors.Wrap(err, "")
+		}
+		dir = filepath.Join(home, "Downloads")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", errors.Wrap(err, "failed create download dir")
+	}
+	return dir, nil
+}
+
+// uniquePath appends a number to the file name while the path exists.
+func uniquePath(p string) string {
+	ext := filepath.Ext(p)
+	base := strings.TrimSuffix(p, ext)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			return p
+		}
+		p = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+}
+
+func postUpload(uploadURL string, filename string, data []byte) error {
+	req, err := http.NewRequest(http.MethodPost, uploadURL, bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed upload file")
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("failed upload file %s: %s", filename, res.Status)
+	}
+	return nil
+}
+
+// apiCall posts a form to a web api method that slack-go does not support.
+func (t *Team) apiCall(method string, values url.Values, v interface{ Err() error }) error {
+	if err := t.online(); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.apiURL+method, strings.NewReader(values.Encode()))
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+t.token)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusTooManyRequests {
+		retry, _ := strconv.ParseInt(res.Header.Get("Retry-After"), 10, 64)
+		return &slack.RateLimitedError{RetryAfter: time.Duration(retry) * time.Second}
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", method, res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return errors.Wrap(err, "failed decode response")
+	}
+	return v.Err()
+}
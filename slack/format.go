@@ -0,0 +1,77 @@
+package slack
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	mrkdwnToken = regexp.MustCompile(`<([^<>]+)>`)
+
+	mrkdwnEntities = strings.NewReplacer(
+		"&amp;", "&",
+		"&lt;", "<",
+		"&gt;", ">",
+	)
+)
+
+// formatText converts slack mrkdwn to readable text.
+// Mentions are resolved to "@name" and "#channel", and links become org-style links.
+func (t *Team) formatText(text string) string {
+	text = mrkdwnToken.ReplaceAllStringFunc(text, func(token string) string {
+		return t.formatToken(token[1 : len(token)-1])
+	})
+	return mrkdwnEntities.Replace(text)
+}
+
+func (t *Team) formatToken(token string) string {
+	target, label := token, ""
+	if i := strings.Index(token, "|"); i >= 0 {
+		target, label = token[:i], token[i+1:]
+	}
+
+	switch {
+	case strings.HasPrefix(target, "@"):
+		id := target[1:]
+		if u := t.lookupUser(id); u != nil {
+			return "@" + u.name
+		}
+		if label != "" {
+			return "@" + strings.TrimPrefix(label, "@")
+		}
+		return "@" + id
+	case strings.HasPrefix(target, "#"):
+		id := target[1:]
+		if c := t.channelByID(id); c != nil {
+			return "#" + c.name
+		}
+		if label != "" {
+			return "#" + label
+		}
+		return "#" + id
+	case strings.HasPrefix(target, "!"):
+		cmd := target[1:]
+		switch {
+		case cmd == "here" || cmd == "channel" || cmd == "everyone":
+			return "@" + cmd
+		case label != "":
+			return label
+		case strings.HasPrefix(cmd, "subteam^"):
+			return "@" + strings.TrimPrefix(cmd, "subteam^")
+		default:
+			return "@" + cmd
+		}
+	default:
+		if label == "" || label == target || "mailto:"+label == target {
+			return orgLink(target, "")
+		}
+		return orgLink(target, label)
+	}
+}
+
+func orgLink(url string, label string) string {
+	if label == "" {
+		return "[[" + url + "]]"
+	}
+	return "[[" + url + "][" + label + "]]"
+}
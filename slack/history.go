@@ -0,0 +1,209 @@
+package slack
+
+import (
+	"github.com/mopemope/emacs-module-go"
+	"github.com/pkg/errors"
+	"github.com/slack-go/slack"
+	"github.com/spf13/viper"
+)
+
+// historyPageSize is the number of messages requested per page.
+const historyPageSize = 200
+
+type HistoryParameters struct {
+	Oldest string
+	Latest string
+	Limit  int
+}
+
+// GetHistory returns messages of the channel oldest first.
+// The bounds argument (:oldest :latest :limit) is required by the module,
+// so callers pass nil for the latest slack.history_limit messages.
+func GetHistory(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	teamName, err := ctx.GoStringArg(0)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	channelName, err := ctx.GoStringArg(1)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	params, err := historyParameters(env, ctx.Arg(2))
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "failed parse history parameters")
+	}
+
+	msgs, err := GetConversationHistory(teamName, channelName, params)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+
+	var items []emacs.Value
+	for _, m := range msgs {
+		items = append(items, m.toPlist(env))
+	}
+	return stdlib.List(items...), nil
+}
+
+// historyParameters reads (:oldest :latest :limit) from a property list.
+func historyParameters(env emacs.Environment, lst emacs.Value) (*HistoryParameters, error) {
+	params := &HistoryParameters{}
+	v, err := plistGet(env, lst, ":oldest")
+	if err != nil {
+		return nil, err
+	}
+	if params.Oldest, err = optString(env, v); err != nil {
+		return nil, err
+	}
+	v, err = plistGet(env, lst, ":latest")
+	if err != nil {
+		return nil, err
+	}
+	if params.Latest, err = optString(env, v); err != nil {
+		return nil, err
+	}
+	v, err = plistGet(env, lst, ":limit")
+	if err != nil {
+		return nil, err
+	}
+	params.Limit = optInt(env, v, 0)
+	return params, nil
+}
+
+// GetConversationHistory returns the messages of the channel between oldest and latest,
+// following cursors until limit messages are fetched. Messages are ordered oldest first.
+// Slack returns the newest messages first, so when more than limit messages are
+// newer than oldest, the latest limit of them are returned, not the ones right
+// after oldest. Older messages are paged with latest set to the oldest ts returned.
+func GetConversationHistory(teamName string, channelName string, params *HistoryParameters) ([]*Message, error) {
+	team, channel := findChannel(teamName, channelName)
+	if channel == nil {
+		return nil, errors.Errorf("failed find channel %s", channelName)
+	}
+	if params == nil {
+		params = &HistoryParameters{}
+	}
+	limit := params.Limit
+	if limit <= 0 {
+		limit = viper.GetInt("slack.history_limit")
+	}
+
+	if team.export != nil {
+		return team.exportHistory(channel, params, limit)
+	}
+
+	var msgs []*Message
+	nextCur := ""
+	for len(msgs) < limit {
+		pageSize := limit - len(msgs)
+		if pageSize > historyPageSize {
+			pageSize = historyPageSize
+		}
+		var res *slack.GetConversationHistoryResponse
+		err := team.retryNow("conversations.history", true, func() error {
+			var err error
+			res, err = team.client.GetConversationHistory(&slack.GetConversationHistoryParameters{
+				ChannelID: channel.id,
+				Cursor:    nextCur,
+				Oldest:    params.Oldest,
+				Latest:    params.Latest,
+				Limit:     pageSize,
+			})
+			return err
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed get conversation history")
+		}
+
+		var page []*Message
+		for i := range res.Messages {
+			page = append(page, team.newMessage(channel.id, &res.Messages[i].Msg))
+		}
+		team.archiveMessages(channel.id, page...)
+		msgs = append(msgs, page...)
+		nextCur = res.ResponseMetaData.NextCursor
+		if !res.HasMore || nextCur == "" {
+			break
+		}
+	}
+	if len(msgs) > limit {
+		msgs = msgs[:limit]
+	}
+
+	// slack returns the newest message first
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	return msgs, nil
+}
+
+func (t *Team) newMessage(channelID string, m *slack.Msg) *Message {
+	userID, user := t.messageUser(m)
+	msg := &Message{
+		timestamp:       m.Timestamp,
+		channel:         t.channelName(channelID),
+		userID:          userID,
+		user:            user,
+		text:            t.renderText(m),
+		threadTimestamp: m.ThreadTimestamp,
+		replyCount:      m.ReplyCount,
+		reactions:       t.newReactions(m.Reactions),
+		attachments:     t.renderAttachments(m.Attachments),
+	}
+	for _, f := range m.Files {
+		msg.files = append(msg.files, &File{
+			id:         f.ID,
+			name:       f.Name,
+			title:      f.Title,
+			mimetype:   f.Mimetype,
+			size:       f.Size,
+			urlPrivate: f.URLPrivate,
+		})
+	}
+	return msg
+}
+
+func (m *Message) toPlist(env emacs.Environment) emacs.Value {
+	return plist(env, m.plistItems(env)...)
+}
+
+func (m *Message) plistItems(env emacs.Environment) []interface{} {
+	var files []emacs.Value
+	for _, f := range m.files {
+		files = append(files, f.toPlist(env))
+	}
+	var reactions []emacs.Value
+	for _, r := range m.reactions {
+		reactions = append(reactions, r.toPlist(env))
+	}
+	var attachments []emacs.Value
+	for _, a := range m.attachments {
+		attachments = append(attachments, plist(env, ":color", a.color, ":text", a.text))
+	}
+	return []interface{}{
+		":ts", m.timestamp,
+		":channel", m.channel,
+		":user-id", m.userID,
+		":user", m.user,
+		":text", m.text,
+		":thread-ts", m.threadTimestamp,
+		":reply-count", m.replyCount,
+		":files", env.StdLib().List(files...),
+		":reactions", env.StdLib().List(reactions...),
+		":attachments", env.StdLib().List(attachments...),
+		":urgent", m.urgent,
+	}
+}
+
+func (f *File) toPlist(env emacs.Environment) emacs.Value {
+	return plist(env,
+		":id", f.id,
+		":name", f.name,
+		":title", f.title,
+		":mimetype", f.mimetype,
+		":size", f.size,
+		":url-private", f.urlPrivate,
+	)
+}
@@ -0,0 +1,137 @@
+package slack
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mopemope/emacs-module-go"
+	"github.com/pkg/errors"
+	"github.com/slack-go/slack"
+	"github.com/spf13/viper"
+)
+
+// reasons a message is delivered to the inbox
+const (
+	InboxMention = "mention"
+	InboxDM      = "dm"
+	InboxWatch   = "watch"
+)
+
+var inbox *messageInbox
+
+// inboxEntry is a message of any team delivered to the inbox.
+type inboxEntry struct {
+	teamName string
+	reason   string
+	message  *Message
+}
+
+// messageInbox keeps the latest entries of all teams ordered by ts.
+// When it is full the oldest entry is dropped.
+type messageInbox struct {
+	mu      sync.Mutex
+	entries []*inboxEntry
+	size    int
+}
+
+func newMessageInbox(size int) *messageInbox {
+	return &messageInbox{
+		size: size,
+	}
+}
+
+func (b *messageInbox) setSize(size int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.size = size
+}
+
+func (b *messageInbox) add(e *inboxEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// teams deliver messages concurrently, so keep entries sorted by ts
+	i := sort.Search(len(b.entries), func(i int) bool {
+		return tsAfter(b.entries[i].message.timestamp, e.message.timestamp)
+	})
+	b.entries = append(b.entries, nil)
+	copy(b.entries[i+1:], b.entries[i:])
+	b.entries[i] = e
+
+	if b.size > 0 && len(b.entries) > b.size {
+		b.entries = b.entries[len(b.entries)-b.size:]
+	}
+}
+
+// since returns entries newer than ts, oldest first.
+func (b *messageInbox) since(ts string) []*inboxEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i := sort.Search(len(b.entries), func(i int) bool {
+		return tsAfter(b.entries[i].message.timestamp, ts)
+	})
+	res := make([]*inboxEntry, len(b.entries)-i)
+	copy(res, b.entries[i:])
+	return res
+}
+
+func GetInbox(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	since, err := optString(env, ctx.Arg(0))
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	var items []emacs.Value
+	for _, e := range inbox.since(since) {
+		kvs := append([]interface{}{
+			":team", e.teamName,
+			":reason", stdlib.Intern(e.reason),
+		}, e.message.plistItems(env)...)
+		items = append(items, plist(env, kvs...))
+	}
+	return stdlib.List(items...), nil
+}
+
+// inboxReason returns why the message is delivered to the inbox, or an empty string.
+// Own messages are never delivered.
+func (t *Team) inboxReason(ev *slack.MessageEvent) string {
+	if ev.User != "" && ev.User == t.userID {
+		return ""
+	}
+	c := t.channelByID(ev.Channel)
+	switch {
+	case t.mentioned(ev.Text):
+		return InboxMention
+	case strings.Contains(ev.Text, "<!here") || strings.Contains(ev.Text, "<!channel") || strings.Contains(ev.Text, "<!everyone"):
+		return InboxMention
+	case c != nil && (c.isIM || c.isMpIM):
+		return InboxDM
+	case c != nil && t.watching(c):
+		return InboxWatch
+	}
+	return ""
+}
+
+// watching reports whether the channel is in slack.watch_channels.
+// An entry is a channel name for any team or "team/channel".
+func (t *Team) watching(c *Channel) bool {
+	for _, w := range viper.GetStringSlice("slack.watch_channels") {
+		if w == c.name || w == t.name+"/"+c.name {
+			return true
+		}
+	}
+	return false
+}
+
+// deliverInbox adds the message to the inbox when it concerns the user.
+func (t *Team) deliverInbox(ev *slack.MessageEvent, m *Message) {
+	if reason := t.inboxReason(ev); reason != "" {
+		inbox.add(&inboxEntry{
+			teamName: t.name,
+			reason:   reason,
+			message:  m,
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package slack
+
+import (
+	"strings"
+
+	"github.com/mopemope/emacs-module-go"
+	"github.com/pkg/errors"
+	"github.com/slack-go/slack"
+)
+
+type Reaction struct {
+	name  string
+	count int
+	users []string
+}
+
+// reactionEvent is a reaction added to or removed from a message.
+type reactionEvent struct {
+	channel   string
+	timestamp string
+	user      string
+	name      string
+}
+
+func AddReaction(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	return reactionCall(ctx, (*Team).AddReaction)
+}
+
+func RemoveReaction(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	return reactionCall(ctx, (*Team).RemoveReaction)
+}
+
+func reactionCall(ctx emacs.FunctionCallContext, f func(*Team, string, string, string) error) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	team, channel, ts, err := messageRefArgs(ctx)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	name, err := ctx.GoStringArg(3)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	if err := f(team, channel, ts, name); err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	return stdlib.T(), nil
+}
+
+func GetReactions(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	team, channel, ts, err := messageRefArgs(ctx)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	reactions, err := team.GetReactions(channel, ts)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	var items []emacs.Value
+	for _, r := range reactions {
+		items = append(items, r.toPlist(env))
+	}
+	return stdlib.List(items...), nil
+}
+
+// messageRefArgs reads team, channel and ts arguments.
+func messageRefArgs(ctx emacs.FunctionCallContext) (*Team, string, string, error) {
+	env := ctx.Environment()
+	teamName, err := ctx.GoStringArg(0)
+	if err != nil {
+		return nil, "", "", err
+	}
+	channel, err := ctx.GoStringArg(1)
+	if err != nil {
+		return nil, "", "", err
+	}
+	ts, err := optString(env, ctx.Arg(2))
+	if err != nil {
+		return nil, "", "", err
+	}
+	team := GetTeam(teamName)
+	if team == nil {
+		return nil, "", "", errors.Errorf("failed find team %s", teamName)
+	}
+	return team, channel, ts, nil
+}
+
+func (t *Team) messageRef(channelName string, ts string) (slack.ItemRef, error) {
+	if err := t.online(); err != nil {
+		return slack.ItemRef{}, err
+	}
+	c := t.channel(channelName)
+	if c == nil {
+		return slack.ItemRef{}, errors.Errorf("failed find channel %s", channelName)
+	}
+	return slack.NewRefToMessage(c.id, ts), nil
+}
+
+func (t *Team) AddReaction(channelName string, ts string, name string) error {
+	ref, err := t.messageRef(channelName, ts)
+	if err != nil {
+		return err
+	}
+	if err := t.client.AddReaction(strings.Trim(name, ":"), ref); err != nil {
+		return errors.Wrap(err, "failed add reaction")
+	}
+	return nil
+}
+
+func (t *Team) RemoveReaction(channelName string, ts string, name string) error {
+	ref, err := t.messageRef(channelName, ts)
+	if err != nil {
+		return err
+	}
+	if err := t.client.RemoveReaction(strings.Trim(name, ":"), ref); err != nil {
+		return errors.Wrap(err, "failed remove reaction")
+	}
+	return nil
+}
+
+func (t *Team) GetReactions(channelName string, ts string) ([]*Reaction, error) {
+	ref, err := t.messageRef(channelName, ts)
+	if err != nil {
+		return nil, err
+	}
+	params := slack.NewGetReactionsParameters()
+	params.Full = true
+	reactions, err := t.client.GetReactions(ref, params)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed get reactions")
+	}
+	return t.newReactions(reactions), nil
+}
+
+func (t *Team) newReactions(reactions []slack.ItemReaction) []*Reaction {
+	var res []*Reaction
+	for _, r := range reactions {
+		reaction := &Reaction{
+			name:  r.Name,
+			count: r.Count,
+		}
+		for _, id := range r.Users {
+			reaction.users = append(reaction.users, t.userName(id))
+		}
+		res = append(res, reaction)
+	}
+	return res
+}
+
+func (r *Reaction) toPlist(env emacs.Environment) emacs.Value {
+	var users []emacs.Value
+	for _, u := range r.users {
+		users = append(users, env.String(u))
+	}
+	return plist(env,
+		":name", r.name,
+		":count", r.count,
+		":users", env.StdLib().List(users...),
+	)
+}
+
+func (t *Team) newReactionEvent(eventType int, ev *slack.ReactionAddedEvent) *Event {
+	return &Event{
+		eventType: eventType,
+		teamName:  t.name,
+		reaction: &reactionEvent{
+			channel:   t.channelName(ev.Item.Channel),
+			timestamp: ev.Item.Timestamp,
+			user:      t.userName(ev.User),
+			name:      ev.Reaction,
+		},
+	}
+}
@@ -0,0 +1,253 @@
+package slack
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/slack-go/slack"
+)
+
+// Attachment is a legacy attachment flattened to text.
+type Attachment struct {
+	color string
+	text  string
+}
+
+// renderText returns the text of a message as the slack client shows it.
+// Blocks take precedence over the text, which is only a fallback for notifications,
+// except for rich_text blocks that mirror the text of messages written by users.
+func (t *Team) renderText(m *slack.Msg) string {
+	text := t.formatText(m.Text)
+	if text != "" && onlyRichText(m.Blocks.BlockSet) {
+		return text
+	}
+	if b := t.renderBlocks(m.Blocks.BlockSet); b != "" {
+		return b
+	}
+	return text
+}
+
+func onlyRichText(blocks []slack.Block) bool {
+	for _, b := range blocks {
+		if b.BlockType() != slack.MBTRichText {
+			return false
+		}
+	}
+	return true
+}
+
+// renderAttachments flattens legacy attachments.
+func (t *Team) renderAttachments(atts []slack.Attachment) []*Attachment {
+	var res []*Attachment
+	for i := range atts {
+		if text := t.renderAttachment(&atts[i]); text != "" {
+			res = append(res, &Attachment{
+				color: atts[i].Color,
+				text:  text,
+			})
+		}
+	}
+	return res
+}
+
+func (t *Team) renderAttachment(a *slack.Attachment) string {
+	var lines []string
+	add := func(s string) {
+		if s != "" {
+			lines = append(lines, s)
+		}
+	}
+	add(t.formatText(a.Pretext))
+	add(a.AuthorName)
+	switch {
+	case a.Title != "" && a.TitleLink != "":
+		add(orgLink(a.TitleLink, a.Title))
+	default:
+		add(a.Title)
+	}
+	add(t.formatText(a.Text))
+	for _, f := range a.Fields {
+		switch {
+		case f.Title == "":
+			add(t.formatText(f.Value))
+		case f.Value == "":
+			add(f.Title)
+		default:
+			add(f.Title + ": " + t.formatText(f.Value))
+		}
+	}
+	add(t.renderBlocks(a.Blocks.BlockSet))
+	add(a.Footer)
+
+	if len(lines) == 0 {
+		return t.formatText(a.Fallback)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// renderBlocks flattens Block Kit blocks to lines of text.
+func (t *Team) renderBlocks(blocks []slack.Block) string {
+	var lines []string
+	for _, b := range blocks {
+		if s := t.renderBlock(b); s != "" {
+			lines = append(lines, s)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (t *Team) renderBlock(block slack.Block) string {
+	switch b := block.(type) {
+	case *slack.HeaderBlock:
+		return t.renderTextObject(b.Text)
+	case *slack.SectionBlock:
+		var lines []string
+		if s := t.renderTextObject(b.Text); s != "" {
+			lines = append(lines, s)
+		}
+		for _, f := range b.Fields {
+			if s := t.renderTextObject(f); s != "" {
+				lines = append(lines, s)
+			}
+		}
+		if b.Accessory != nil && b.Accessory.ButtonElement != nil {
+			lines = append(lines, t.renderButton(b.Accessory.ButtonElement))
+		}
+		return strings.Join(lines, "\n")
+	case *slack.ContextBlock:
+		var items []string
+		for _, e := range b.ContextElements.Elements {
+			switch e := e.(type) {
+			case *slack.TextBlockObject:
+				items = append(items, t.renderTextObject(e))
+			case *slack.ImageBlockElement:
+				if e.AltText != "" {
+					items = append(items, e.AltText)
+				}
+			}
+		}
+		return strings.Join(items, " ")
+	case *slack.DividerBlock:
+		return "-----"
+	case *slack.ImageBlock:
+		label := b.AltText
+		if b.Title != nil && b.Title.Text != "" {
+			label = b.Title.Text
+		}
+		return orgLink(b.ImageURL, label)
+	case *slack.ActionBlock:
+		if b.Elements == nil {
+			return ""
+		}
+		var items []string
+		for _, e := range b.Elements.ElementSet {
+			if button, ok := e.(*slack.ButtonBlockElement); ok {
+				items = append(items, t.renderButton(button))
+			}
+		}
+		return strings.Join(items, " ")
+	case *slack.RichTextBlock:
+		var parts []string
+		for _, e := range b.Elements {
+			if s := t.renderRichTextElement(e); s != "" {
+				parts = append(parts, s)
+			}
+		}
+		return strings.Join(parts, "\n")
+	}
+	return ""
+}
+
+func (t *Team) renderTextObject(o *slack.TextBlockObject) string {
+	if o == nil {
+		return ""
+	}
+	if o.Type == slack.MarkdownType {
+		return t.formatText(o.Text)
+	}
+	return o.Text
+}
+
+func (t *Team) renderButton(b *slack.ButtonBlockElement) string {
+	label := t.renderTextObject(b.Text)
+	if b.URL != "" {
+		return orgLink(b.URL, label)
+	}
+	return "[" + label + "]"
+}
+
+// richTextList is a rich_text_list, which slack-go decodes as RichTextUnknown.
+type richTextList struct {
+	Style    string                  `json:"style"`
+	Indent   int                     `json:"indent"`
+	Elements []slack.RichTextSection `json:"elements"`
+}
+
+func (t *Team) renderRichTextElement(e slack.RichTextElement) string {
+	switch e := e.(type) {
+	case *slack.RichTextSection:
+		return t.renderRichTextSection(e)
+	case *slack.RichTextUnknown:
+		switch e.Type {
+		case slack.RTEList:
+			var l richTextList
+			if err := json.Unmarshal([]byte(e.Raw), &l); err != nil {
+				log.Debug().Msgf("failed decode rich text list: %s", err)
+				return ""
+			}
+			indent := strings.Repeat("  ", l.Indent)
+			var lines []string
+			for i := range l.Elements {
+				mark := "• "
+				if l.Style == "ordered" {
+					mark = fmt.Sprintf("%d. ", i+1)
+				}
+				lines = append(lines, indent+mark+t.renderRichTextSection(&l.Elements[i]))
+			}
+			return strings.Join(lines, "\n")
+		case slack.RTEPreformatted, slack.RTEQuote:
+			// their elements are the same as the ones of rich_text_section
+			var s slack.RichTextSection
+			if err := json.Unmarshal([]byte(e.Raw), &s); err != nil {
+				log.Debug().Msgf("failed decode rich text %s: %s", e.Type, err)
+				return ""
+			}
+			text := t.renderRichTextSection(&s)
+			if e.Type == slack.RTEPreformatted {
+				return "```\n" + text + "\n```"
+			}
+			return "> " + strings.ReplaceAll(text, "\n", "\n> ")
+		}
+	}
+	return ""
+}
+
+func (t *Team) renderRichTextSection(s *slack.RichTextSection) string {
+	var b strings.Builder
+	for _, e := range s.Elements {
+		switch e := e.(type) {
+		case *slack.RichTextSectionTextElement:
+			b.WriteString(e.Text)
+		case *slack.RichTextSectionUserElement:
+			b.WriteString("@" + t.userName(e.UserID))
+		case *slack.RichTextSectionChannelElement:
+			b.WriteString("#" + t.channelName(e.ChannelID))
+		case *slack.RichTextSectionEmojiElement:
+			b.WriteString(":" + e.Name + ":")
+		case *slack.RichTextSectionLinkElement:
+			b.WriteString(orgLink(e.URL, e.Text))
+		case *slack.RichTextSectionUserGroupElement:
+			b.WriteString("@" + e.UsergroupID)
+		case *slack.RichTextSectionBroadcastElement:
+			b.WriteString("@" + e.Range)
+		case *slack.RichTextSectionDateElement:
+			b.WriteString(time.Unix(int64(e.Timestamp), 0).Format("2006-01-02 15:04"))
+		case *slack.RichTextSectionColorElement:
+			b.WriteString(e.Value)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,121 @@
+package slack
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/slack-go/slack"
+	"github.com/spf13/viper"
+)
+
+const retryMaxBackoff = time.Minute
+
+// retry calls fn until it succeeds or slack.retry_max retries are done.
+// Rate limited calls are retried after Retry-After, which is safe for any call
+// because slack rejected the request. Transient network and server errors are
+// retried with backoff only when idempotent is true, because the request may
+// have been processed. Each retry is reported as a progress event.
+// It sleeps on the calling goroutine, so calls made while emacs waits use retryNow.
+func (t *Team) retry(op string, idempotent bool, fn func() error) error {
+	return t.retryWithin(0, op, idempotent, fn)
+}
+
+// retryNow is retry for calls made while emacs waits. When the retries would
+// wait more than slack.retry_max_wait in total, the error is returned instead.
+func (t *Team) retryNow(op string, idempotent bool, fn func() error) error {
+	return t.retryWithin(viper.GetDuration("slack.retry_max_wait"), op, idempotent, fn)
+}
+
+// retryWithin is retry waiting limit in total, or without a limit when it is 0.
+func (t *Team) retryWithin(limit time.Duration, op string, idempotent bool, fn func() error) error {
+	backoff := viper.GetDuration("slack.retry_backoff")
+	max := viper.GetInt("slack.retry_max")
+	var waited time.Duration
+	for n := 1; ; n++ {
+		err := fn()
+		if err == nil || n > max {
+			return err
+		}
+		var wait time.Duration
+		switch {
+		case isRateLimited(err):
+			wait = errors.Cause(err).(*slack.RateLimitedError).RetryAfter
+		case idempotent && isTransient(err):
+			wait = backoff
+			backoff *= 2
+			if backoff > retryMaxBackoff {
+				backoff = retryMaxBackoff
+			}
+		default:
+			return err
+		}
+		waited += wait
+		if limit > 0 && waited > limit {
+			return err
+		}
+		t.progress(fmt.Sprintf("%s: %s, retry %d/%d in %s", op, err, n, max, wait))
+		time.Sleep(wait)
+	}
+}
+
+func isRateLimited(err error) bool {
+	_, ok := errors.Cause(err).(*slack.RateLimitedError)
+	return ok
+}
+
+// isTransient reports whether the error is a server error or a network timeout
+// which may succeed when retried. Errors such as a failed DNS lookup or
+// a refused connection fail again, so they are not retried.
+func isTransient(err error) bool {
+	switch err := errors.Cause(err).(type) {
+	case slack.StatusCodeError:
+		return err.Code >= http.StatusInternalServerError
+	case net.Error:
+		if err.Timeout() {
+			return true
+		}
+		// Temporary is deprecated but still set by some errors
+		if tmp, ok := err.(interface{ Temporary() bool }); ok {
+			return tmp.Temporary()
+		}
+		return false
+	}
+	err = errors.Cause(err)
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// progress reports progress of long running calls as an event and a log.
+func (t *Team) progress(text string) {
+	log.Debug().Msgf("[%s] %s", t.name, text)
+	events.push(t.newEvent(EventProgress, text))
+}
+
+// getUsers fetches users page by page, retrying a failed page instead of all users.
+func (t *Team) getUsers() ([]slack.User, error) {
+	var users []slack.User
+	p := t.client.GetUsersPaginated(slack.GetUsersOptionLimit(1000))
+	for {
+		var next slack.UserPagination
+		err := t.retry("users.list", true, func() error {
+			var err error
+			// keep p on failure because a failed Next may look complete
+			next, err = p.Next(context.Background())
+			return err
+		})
+		if p.Done(err) {
+			return users, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		p = next
+		users = append(users, p.Users...)
+		t.progress(fmt.Sprintf("fetched %d users", len(users)))
+	}
+}
@@ -0,0 +1,199 @@
+package slack
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/slack-go/slack"
+	"github.com/spf13/viper"
+)
+
+// ruleConfig is an entry of slack.rules.
+// All conditions set must match. team, channel and user are names or ids.
+type ruleConfig struct {
+	Name    string `mapstructure:"name"`
+	Team    string `mapstructure:"team"`
+	Channel string `mapstructure:"channel"`
+	User    string `mapstructure:"user"`
+	Regex   string `mapstructure:"regex"`
+	Mention bool   `mapstructure:"mention"`
+
+	Notify bool `mapstructure:"notify"`
+	Speak  bool `mapstructure:"speak"`
+	Urgent bool `mapstructure:"urgent"`
+}
+
+// rule is a compiled entry of slack.rules.
+type rule struct {
+	ruleConfig
+	re *regexp.Regexp
+}
+
+// ruleActions merges the actions of all rules matching a message.
+type ruleActions struct {
+	rules  []string
+	notify bool
+	speak  bool
+	urgent bool
+}
+
+// Speaker reads text aloud. speech.Speaker implements it.
+type Speaker interface {
+	Speak(text string) error
+}
+
+// speechQueueSize is the number of messages waiting to be spoken.
+// Messages arriving while the queue is full are not spoken.
+const speechQueueSize = 16
+
+var (
+	rules   []*rule
+	speaker Speaker
+	// speechQueue passes texts to the worker speaking them one by one
+	speechQueue chan string
+	rulesMu     sync.RWMutex
+)
+
+// SetSpeaker sets the speaker of rules with speak and starts the speech worker.
+func SetSpeaker(s Speaker) {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	speaker = s
+	if speechQueue == nil {
+		speechQueue = make(chan string, speechQueueSize)
+		go speakQueue(speechQueue)
+	}
+}
+
+// speakQueue speaks texts in order so that messages never play over each other.
+func speakQueue(q <-chan string) {
+	for text := range q {
+		rulesMu.RLock()
+		s := speaker
+		rulesMu.RUnlock()
+		if s == nil {
+			continue
+		}
+		if err := s.Speak(text); err != nil {
+			log.Debug().Msgf("failed speak slack message: %s", err)
+		}
+	}
+}
+
+// speak queues the text without blocking the connection.
+func speak(text string) {
+	rulesMu.RLock()
+	q, s := speechQueue, speaker
+	rulesMu.RUnlock()
+	if q == nil || s == nil {
+		log.Debug().Msg("no speaker to speak slack message")
+		return
+	}
+	select {
+	case q <- text:
+	default:
+		log.Debug().Msg("speech queue is full, skip slack message")
+	}
+}
+
+// loadRules compiles slack.rules and replaces the current rules.
+func loadRules() error {
+	var configs []ruleConfig
+	if err := viper.UnmarshalKey("slack.rules", &configs); err != nil {
+		return errors.Wrap(err, "failed read slack.rules")
+	}
+	var res []*rule
+	for i := range configs {
+		r := &rule{ruleConfig: configs[i]}
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule%d", i+1)
+		}
+		if r.Regex != "" {
+			re, err := regexp.Compile(r.Regex)
+			if err != nil {
+				return errors.Wrapf(err, "failed compile regex of %s", r.Name)
+			}
+			r.re = re
+		}
+		res = append(res, r)
+	}
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	rules = res
+	return nil
+}
+
+func (r *rule) match(t *Team, ev *slack.MessageEvent, m *Message) bool {
+	if r.Team != "" && r.Team != t.name {
+		return false
+	}
+	if r.Channel != "" && r.Channel != ev.Channel && strings.TrimPrefix(r.Channel, "#") != m.channel {
+		return false
+	}
+	if r.User != "" && r.User != m.userID && strings.TrimPrefix(r.User, "@") != m.user {
+		return false
+	}
+	if r.Mention && !t.mentioned(ev.Text) {
+		return false
+	}
+	if r.re != nil && !r.re.MatchString(m.archiveText()) {
+		return false
+	}
+	return true
+}
+
+// matchRules returns the actions of rules matching the message.
+// Own messages match no rule.
+func (t *Team) matchRules(ev *slack.MessageEvent, m *Message) *ruleActions {
+	if ev.User != "" && ev.User == t.userID {
+		return nil
+	}
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+	var a *ruleActions
+	for _, r := range rules {
+		if !r.match(t, ev, m) {
+			continue
+		}
+		if a == nil {
+			a = &ruleActions{}
+		}
+		a.rules = append(a.rules, r.Name)
+		a.notify = a.notify || r.Notify
+		a.speak = a.speak || r.Speak
+		a.urgent = a.urgent || r.Urgent
+	}
+	return a
+}
+
+// applyRules runs the actions of rules matching the message.
+// Urgent messages are marked, notifications are queued as events
+// and messages to speak are queued to the speech worker.
+func (t *Team) applyRules(ev *slack.MessageEvent, m *Message, callback RTMCallback) {
+	a := t.matchRules(ev, m)
+	if a == nil {
+		return
+	}
+	log.Debug().Msgf("message %s matches rules %v", m.timestamp, a.rules)
+	m.urgent = a.urgent
+	if a.notify {
+		callback(&Event{
+			eventType: EventNotification,
+			teamName:  t.name,
+			text:      strings.Join(a.rules, ","),
+			message:   m,
+		})
+	}
+	if a.speak {
+		speak(fmt.Sprintf("%s %s", m.user, m.archiveText()))
+	}
+}
+
+// mentioned reports whether the text mentions the user of the team directly.
+func (t *Team) mentioned(text string) bool {
+	return t.userID != "" && strings.Contains(text, "<@"+t.userID+">")
+}
@@ -0,0 +1,120 @@
+package slack
+
+import (
+	"strings"
+
+	"github.com/mopemope/emacs-module-go"
+	"github.com/pkg/errors"
+	"github.com/slack-go/slack"
+)
+
+// Sort orders of SearchMessages
+const (
+	SearchSortScore  = "score"
+	SearchSortNewest = "newest"
+	SearchSortOldest = "oldest"
+)
+
+// search.messages wraps matched terms with these characters when highlight is set
+var searchHighlight = strings.NewReplacer("\ue000", "*", "\ue001", "*")
+
+type SearchResult struct {
+	Channel   string
+	User      string
+	Timestamp string
+	Permalink string
+	Snippet   string
+}
+
+func SearchMessages(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	teamName, err := ctx.GoStringArg(0)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	query, err := ctx.GoStringArg(1)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	sortOrder := SearchSortScore
+	if env.GoBool(ctx.Arg(2)) {
+		if sortOrder, err = symbolName(env, ctx.Arg(2)); err != nil {
+			return stdlib.Nil(), errors.Wrap(err, "")
+		}
+	}
+	page := optInt(env, ctx.Arg(3), 1)
+
+	team := GetTeam(teamName)
+	if team == nil {
+		return stdlib.Nil(), errors.Errorf("failed find team %s", teamName)
+	}
+	results, err := team.SearchMessages(query, sortOrder, page)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+
+	var items []emacs.Value
+	for _, r := range results {
+		items = append(items, plist(env,
+			":team", team.name,
+			":channel", r.Channel,
+			":user", r.User,
+			":ts", r.Timestamp,
+			":permalink", r.Permalink,
+			":snippet", r.Snippet,
+		))
+	}
+	return stdlib.List(items...), nil
+}
+
+// SearchMessages searches messages with search.messages.
+// sortOrder is one of score, newest and oldest, and page starts from 1.
+func (t *Team) SearchMessages(query string, sortOrder string, page int) ([]*SearchResult, error) {
+	if err := t.online(); err != nil {
+		return nil, err
+	}
+	params := slack.NewSearchParameters()
+	params.Highlight = true
+	if page > 0 {
+		params.Page = page
+	}
+	switch sortOrder {
+	case SearchSortScore, "":
+	case SearchSortNewest:
+		params.Sort = "timestamp"
+	case SearchSortOldest:
+		params.Sort = "timestamp"
+		params.SortDirection = "asc"
+	default:
+		return nil, errors.Errorf("unknown sort order %s", sortOrder)
+	}
+
+	res, err := t.client.SearchMessages(query, params)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed search messages")
+	}
+	var results []*SearchResult
+	for i := range res.Matches {
+		results = append(results, t.newSearchResult(&res.Matches[i]))
+	}
+	return results, nil
+}
+
+func (t *Team) newSearchResult(m *slack.SearchMessage) *SearchResult {
+	channel := m.Channel.Name
+	if c := t.channelByID(m.Channel.ID); c != nil {
+		channel = c.name
+	}
+	user := m.Username
+	if u := t.lookupUser(m.User); u != nil {
+		user = u.name
+	}
+	return &SearchResult{
+		Channel:   channel,
+		User:      user,
+		Timestamp: m.Timestamp,
+		Permalink: m.Permalink,
+		Snippet:   searchHighlight.Replace(t.formatText(m.Text)),
+	}
+}
@@ -1,7 +1,11 @@
 package slack
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"sync"
+	"time"
 
 	"github.com/mopemope/emacs-module-go"
 	"github.com/pkg/errors"
@@ -13,39 +17,136 @@ import (
 var teams map[string]*Team
 
 type Team struct {
-	name      string
-	client    *slack.Client
+	name     string
+	token    string
+	appToken string
+	userID   string
+	client   *slack.Client
+	// url of the web api, which apiCall calls like client
+	apiURL    string
 	channels  map[string]*Channel
 	channelID map[string]*Channel
-	users     map[string]*User
+	// public channels JoinableChannels fetched last
+	joinable []slack.Channel
+	users    map[string]*User
+	// ids users.info or bots.info failed for, and names of bots
+	unknown map[string]bool
+	bots    map[string]string
+
+	chmu sync.RWMutex
+	// umu guards users, unknown and bots
+	umu sync.RWMutex
+	// cmu serializes writes of the cache file
+	cmu sync.Mutex
+
+	// mu guards cancel and stop. cancel is set while the team is running,
+	// stop once its connection can be closed.
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	stop   func() error
+
+	// export is set for read-only teams opened from a workspace export
+	export *exportArchive
+}
+
+// tokenConfig is an entry of slack.tokens.
+// An entry is either a token string or a table with token and app_token.
+// Teams with an app_token connect through Socket Mode instead of RTM.
+type tokenConfig struct {
+	token    string
+	appToken string
 }
 
 type Channel struct {
-	teamName string
-	id       string
-	name     string
+	teamName  string
+	id        string
+	name      string
+	isIM      bool
+	isMpIM    bool
+	isPrivate bool
+	// counterpart users of im and mpim
+	userIDs []string
+
+	mu   sync.Mutex
+	read readState
+	info channelInfo
+}
+
+// channelInfo is the metadata of a channel which changes while connected.
+type channelInfo struct {
+	topic      string
+	purpose    string
+	numMembers int
+	muted      bool
 }
 
 type User struct {
 	id   string
 	name string
+	// the slack username, which name replaces with the real name
+	handle string
+
+	displayName string
+	realName    string
+	title       string
+	email       string
+	tz          string
+	// offset from UTC in seconds
+	tzOffset int
+	isBot    bool
+	deleted  bool
+	avatar   string
 }
 
 type Message struct {
-	timestamp string
-	user      string
-	text      string
+	timestamp       string
+	channel         string
+	userID          string
+	user            string
+	text            string
+	threadTimestamp string
+	replyCount      int
+	files           []*File
+	reactions       []*Reaction
+	attachments     []*Attachment
+	// set by notification rules
+	urgent bool
+}
+
+type File struct {
+	id         string
+	name       string
+	title      string
+	mimetype   string
+	size       int
+	urlPrivate string
 }
 
 func InitSlack(ctx emacs.FunctionCallContext) (emacs.Value, error) {
 	env := ctx.Environment()
 	stdlib := env.StdLib()
-	tokens := viper.GetStringSlice("slack.tokens")
-
-	teams, err := initSlack(tokens...)
+	if err := loadRules(); err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	teams, err := initSlack(slackTokens()...)
 	if err != nil {
 		return stdlib.Nil(), errors.Wrap(err, "")
 	}
+	events.setSize(viper.GetInt("slack.event_queue_size"))
+	inbox.setSize(viper.GetInt("slack.inbox_size"))
+	// the archive is optional, e.g. another emacs may hold the database
+	if _, err := openArchive(); err != nil {
+		log.Debug().Msgf("failed open archive: %s", err)
+		events.push(&Event{
+			eventType: EventError,
+			text:      fmt.Sprintf("failed open archive: %s", err),
+		})
+	}
+	exports, err := openExports()
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	teams = append(teams, exports...)
 
 	var items []emacs.Value
 	for _, team := range teams {
@@ -59,21 +160,60 @@ func InitSlack(ctx emacs.FunctionCallContext) (emacs.Value, error) {
 func GetChannels(ctx emacs.FunctionCallContext) (emacs.Value, error) {
 	env := ctx.Environment()
 	stdlib := env.StdLib()
-	teamName, err := ctx.GoStringArg(0)
+	team, err := teamArg(ctx)
 	if err != nil {
 		return stdlib.Nil(), errors.Wrap(err, "")
 	}
-	team := GetTeam(teamName)
 	var items []emacs.Value
-	for _, c := range team.GetChannels() {
-		name := env.String(c.name)
-		items = append(items, name)
+	for _, c := range team.SortedChannels() {
+		items = append(items, env.String(c.name))
+	}
+	return stdlib.List(items...), nil
+}
+
+// GetChannelDetails returns the channels of the team as plists.
+func GetChannelDetails(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	team, err := teamArg(ctx)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	var items []emacs.Value
+	for _, c := range team.SortedChannels() {
+		items = append(items, c.toPlist(env))
 	}
 	return stdlib.List(items...), nil
 }
 
 func PostMessage(ctx emacs.FunctionCallContext) (emacs.Value, error) {
-	stdlib := ctx.Environment().StdLib()
+	return postMessageArgs(ctx)
+}
+
+// PostThreadMessage posts into the thread of thread-ts, also sending it to
+// the channel when broadcast is non-nil. A nil thread-ts posts to the channel.
+func PostThreadMessage(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	threadTS, err := optString(env, ctx.Arg(3))
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	var options []slack.MsgOption
+	if threadTS != "" {
+		options = append(options, slack.MsgOptionTS(threadTS))
+		if env.GoBool(ctx.Arg(4)) {
+			options = append(options, slack.MsgOptionBroadcast())
+		}
+	}
+	return postMessageArgs(ctx, options...)
+}
+
+// postMessageArgs posts the text of the team channel text arguments
+// and returns the ts of the posted message.
+func postMessageArgs(ctx emacs.FunctionCallContext, options ...slack.MsgOption) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
 	team, err := ctx.GoStringArg(0)
 	if err != nil {
 		return stdlib.Nil(), errors.Wrap(err, "")
@@ -86,96 +226,165 @@ func PostMessage(ctx emacs.FunctionCallContext) (emacs.Value, error) {
 	if err != nil {
 		return stdlib.Nil(), errors.Wrap(err, "")
 	}
-	if _, err := postMessage(team, channel, text); err != nil {
+	ts, err := postMessage(team, channel, text, options...)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	if ts == "" {
+		return stdlib.Nil(), nil
+	}
+	return env.String(ts), nil
+}
+
+func UpdateMessage(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	team, channel, ts, err := messageRefArgs(ctx)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	text, err := ctx.GoStringArg(3)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	if err := team.UpdateMessage(channel, ts, text); err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	return stdlib.T(), nil
+}
+
+func DeleteMessage(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	team, channel, ts, err := messageRefArgs(ctx)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	if err := team.DeleteMessage(channel, ts); err != nil {
 		return stdlib.Nil(), errors.Wrap(err, "")
 	}
 	return stdlib.T(), nil
 }
 
-func initSlack(tokens ...string) ([]*Team, error) {
+func slackTokens() []tokenConfig {
+	var res []tokenConfig
+	switch v := viper.Get("slack.tokens").(type) {
+	case []map[string]interface{}:
+		for _, item := range v {
+			res = append(res, newTokenConfig(item))
+		}
+	case []interface{}:
+		for _, item := range v {
+			switch item := item.(type) {
+			case string:
+				res = append(res, tokenConfig{token: item})
+			case map[string]interface{}:
+				res = append(res, newTokenConfig(item))
+			}
+		}
+	default:
+		for _, token := range viper.GetStringSlice("slack.tokens") {
+			res = append(res, tokenConfig{token: token})
+		}
+	}
+	return res
+}
+
+func newTokenConfig(item map[string]interface{}) tokenConfig {
+	token, _ := item["token"].(string)
+	appToken, _ := item["app_token"].(string)
+	return tokenConfig{
+		token:    token,
+		appToken: appToken,
+	}
+}
+
+// initSlack connects teams of the tokens. A team which fails to connect is
+// reported as an error event and skipped, and an error is returned only when
+// no team is connected.
+func initSlack(tokens ...tokenConfig) ([]*Team, error) {
 	var res []*Team
+	var lastErr error
 	for _, token := range tokens {
 		t, err := connectTeam(token)
 		if err != nil {
-			return nil, err
+			log.Debug().Msgf("failed connect team: %s", err)
+			events.push(&Event{
+				eventType: EventError,
+				text:      fmt.Sprintf("failed connect team: %s", err),
+			})
+			lastErr = err
+			continue
 		}
 		res = append(res, t)
 	}
+	if len(res) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
 	return res, nil
 }
 
-func connectTeam(token string) (*Team, error) {
-	client := slack.New(token)
-	info, err := client.GetTeamInfo()
-	if err != nil {
-		return nil, errors.Wrap(err, "failed get team info")
-	}
-
-	log.Debug().Msgf("connected team [%s]", info.Name)
-
+// connectTeam restores the team from the cache and refreshes it in background.
+// Without a cache, channels and users are fetched in background too, so that
+// retries of the many calls do not block emacs.
+func connectTeam(tc tokenConfig) (*Team, error) {
 	team := &Team{
-		name:      info.Name,
-		client:    client,
+		token:     tc.token,
+		appToken:  tc.appToken,
 		channels:  map[string]*Channel{},
 		channelID: map[string]*Channel{},
 		users:     map[string]*User{},
 	}
-
-	nextCur := ""
-	for {
-		channels, cursor, err := client.GetConversations(&slack.GetConversationsParameters{
-			Types:  []string{"public_channel", "private_channel"},
-			Limit:  1000,
-			Cursor: nextCur,
-		})
-		if err != nil {
-			return nil, errors.Wrap(err, "failed get team channels")
-		}
-
-		for _, channel := range channels {
-			if channel.IsMember {
-				c := &Channel{
-					id:       channel.ID,
-					name:     channel.Name,
-					teamName: info.Name,
-				}
-				team.channels[channel.Name] = c
-				team.channelID[channel.ID] = c
-				log.Debug().Msgf("find channel %s:%s", channel.Name, channel.ID)
-			}
-		}
-		if cursor == "" {
-			break
-		} else {
-			nextCur = cursor
-		}
+	team.setClient(slack.APIURL)
+	if team.loadCache() {
+		teams[team.name] = team
+		go team.refreshInBackground()
+		return team, nil
 	}
 
-	users, err := client.GetUsers()
+	var info *slack.TeamInfo
+	err := team.retryNow("team.info", true, func() error {
+		var err error
+		info, err = team.client.GetTeamInfo()
+		return err
+	})
 	if err != nil {
-		return nil, errors.Wrap(err, "failed get team users")
+		return nil, errors.Wrap(err, "failed get team info")
 	}
-	for _, u := range users {
-		name := u.RealName
-		if name == "" {
-			name = u.Name
-		}
-		team.users[u.ID] = &User{
-			id:   u.ID,
-			name: name,
-		}
-		log.Debug().Msgf("find user %s:%s:%s", u.ID, u.Name, u.RealName)
+	team.name = info.Name
+
+	log.Debug().Msgf("connected team [%s]", info.Name)
+
+	var auth *slack.AuthTestResponse
+	err = team.retryNow("auth.test", true, func() error {
+		var err error
+		auth, err = team.client.AuthTest()
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed auth test")
 	}
+	team.userID = auth.UserID
 
 	teams[info.Name] = team
+	go team.refreshInBackground()
 	return team, nil
 }
 
+// setClient creates the web api client calling apiURL.
+// apiCall shares the url and the http client with it.
+func (t *Team) setClient(apiURL string) {
+	t.apiURL = apiURL
+	t.client = slack.New(t.token, slack.OptionAPIURL(apiURL), slack.OptionHTTPClient(http.DefaultClient))
+}
+
 func GetTeam(name string) *Team {
 	return teams[name]
 }
 
 func (t *Team) GetChannels() []*Channel {
+	t.chmu.RLock()
+	defer t.chmu.RUnlock()
 	var chs []*Channel
 	for _, c := range t.channels {
 		chs = append(chs, c)
@@ -183,132 +392,417 @@ func (t *Team) GetChannels() []*Channel {
 	return chs
 }
 
-type RTMCallback func(int, ...string)
+type RTMCallback func(*Event)
 
-func (t *Team) StartRTM(callback RTMCallback) {
+// Start receives events with Socket Mode when the team has an app-level token,
+// otherwise with RTM. ctx is the run begin returned.
+// It blocks until Stop is called.
+func (t *Team) Start(ctx context.Context, callback RTMCallback) {
+	defer t.end(ctx)
+	if err := t.online(); err != nil {
+		callback(t.newEvent(EventError, err.Error()))
+		return
+	}
+	if t.appToken != "" {
+		t.StartSocketMode(ctx, callback)
+		return
+	}
+	t.StartRTM(ctx, callback)
+}
+
+func (t *Team) StartRTM(ctx context.Context, callback RTMCallback) {
 	rtm := t.client.NewRTM()
+	if !t.setStop(ctx, rtm.Disconnect) {
+		log.Debug().Msgf("team [%s] stopped before connecting", t.name)
+		return
+	}
+
 	go rtm.ManageConnection()
 
 	for msg := range rtm.IncomingEvents {
 		// log.Debug().Msg("Event Received: ")
-		switch ev := msg.Data.(type) {
-		case *slack.HelloEvent:
-			// type: 0
-			callback(0, "hello")
-		case *slack.ConnectedEvent:
-			// type: 1
-			log.Debug().Msgf("Infos: %v", ev.Info)
-			log.Debug().Msgf("Connection counter:%v", ev.ConnectionCount)
-			callback(1, "connected")
-
-		case *slack.MessageEvent:
-			// type: 2
-			ch := t.channelID[ev.Channel].name
-			user := t.users[ev.User].name
-
-			log.Debug().Msgf("Message: %s ch:%s user:%s text:%s", ev.Timestamp, ch, user, ev.Text)
-
-			callback(2, ev.Timestamp, ch, user, ev.Text)
-
-		case *slack.PresenceChangeEvent:
-			// type: 3
-			log.Debug().Msgf("Presence Change: %v", ev)
-			// callback(3, "")
-
-		case *slack.LatencyReport:
-			// type: 4
-			log.Debug().Msgf("Current latency: %v", ev.Value)
-			// callback(4, "")
-
-		case *slack.DesktopNotificationEvent:
-			// type: 5
-			log.Debug().Msgf("Desktop Notification: %v", ev)
-			// callback(5, "")
-
-		case *slack.RTMError:
-			// type: 6
-			log.Debug().Msgf("Error: %s", ev.Error())
-			callback(6, ev.Error())
-
-		case *slack.InvalidAuthEvent:
-			// type: 7
-			log.Debug().Msg("Invalid credentials")
+		if ev, ok := msg.Data.(*slack.DisconnectedEvent); ok {
+			if ev.Intentional {
+				log.Debug().Msgf("disconnected team [%s]", t.name)
+				return
+			}
+			continue
+		}
+		if _, ok := msg.Data.(*slack.HelloEvent); ok {
+			// presence changes are sent only for subscribed users
+			if ids := t.presenceUsers(); len(ids) > 0 {
+				rtm.SendMessage(rtm.NewSubscribeUserPresence(ids))
+			}
+		}
+		if !t.handleEvent(msg.Data, callback) {
 			return
+		}
+	}
+}
+
+// handleEvent passes a decoded RTM event to callback.
+// It returns false when the connection should not be continued.
+func (t *Team) handleEvent(data interface{}, callback RTMCallback) bool {
+	switch ev := data.(type) {
+	case *slack.HelloEvent:
+		callback(t.newEvent(EventHello, "hello"))
+	case *slack.ConnectedEvent:
+		log.Debug().Msgf("Infos: %v", ev.Info)
+		log.Debug().Msgf("Connection counter:%v", ev.ConnectionCount)
+		callback(t.newEvent(EventConnected, "connected"))
+
+	case *slack.MessageEvent:
+		switch ev.SubType {
+		case "message_changed":
+			if ev.SubMessage != nil {
+				m := t.newMessage(ev.Channel, ev.SubMessage)
+				t.archiveMessages(ev.Channel, m)
+				callback(&Event{
+					eventType: EventMessageChanged,
+					teamName:  t.name,
+					message:   m,
+				})
+			}
+			return true
+		case "channel_topic", "group_topic", "channel_purpose", "group_purpose", "channel_join", "group_join", "channel_leave", "group_leave":
+			t.updateChannelInfo(ev)
+		case "message_deleted":
+			t.unarchiveMessage(ev.Channel, ev.DeletedTimestamp)
+			callback(&Event{
+				eventType: EventMessageDeleted,
+				teamName:  t.name,
+				message: &Message{
+					timestamp: ev.DeletedTimestamp,
+					channel:   t.channelName(ev.Channel),
+				},
+			})
+			return true
+		}
+		if ev.Hidden {
+			// other hidden subtypes such as message_replied carry no message
+			log.Debug().Msgf("skip hidden message %s", ev.SubType)
+			return true
+		}
+
+		t.trackUnread(ev)
+		m := t.newMessage(ev.Channel, &ev.Msg)
+		t.archiveMessages(ev.Channel, m)
+		t.applyRules(ev, m, callback)
+		t.deliverInbox(ev, m)
+
+		log.Debug().Msgf("Message: %s ch:%s user:%s text:%s", m.timestamp, m.channel, m.user, m.text)
+
+		callback(&Event{
+			eventType: EventMessage,
+			teamName:  t.name,
+			message:   m,
+		})
 
-		default:
+	case *slack.ReactionAddedEvent:
+		callback(t.newReactionEvent(EventReactionAdded, ev))
 
-			// Ignore other events..
-			// fmt.Printf("Unexpected: %v\n", msg.Data)
+	case *slack.ReactionRemovedEvent:
+		callback(t.newReactionEvent(EventReactionRemoved, (*slack.ReactionAddedEvent)(ev)))
+
+	case *slack.ChannelMarkedEvent:
+		t.trackMarked(ev.Channel, ev.Timestamp)
+
+	case *slack.IMMarkedEvent:
+		t.trackMarked(ev.Channel, ev.Timestamp)
+
+	case *slack.GroupMarkedEvent:
+		t.trackMarked(ev.Channel, ev.Timestamp)
+
+	case *slack.PresenceChangeEvent:
+		log.Debug().Msgf("Presence Change: %v", ev)
+		for _, e := range t.newPresenceEvents(ev) {
+			callback(e)
 		}
+
+	case *slack.DNDUpdatedEvent:
+		log.Debug().Msgf("DND Updated: %v", ev)
+		callback(t.newDNDEvent(ev))
+
+	case *slack.LatencyReport:
+		log.Debug().Msgf("Current latency: %v", ev.Value)
+		// callback(EventLatencyReport, "")
+
+	case *slack.DesktopNotificationEvent:
+		log.Debug().Msgf("Desktop Notification: %v", ev)
+		// callback(EventDesktopNotification, "")
+
+	case *slack.RTMError:
+		log.Debug().Msgf("Error: %s", ev.Error())
+		callback(t.newEvent(EventError, ev.Error()))
+
+	case *slack.InvalidAuthEvent:
+		log.Debug().Msg("Invalid credentials")
+		callback(t.newEvent(EventInvalidAuth, "invalid credentials"))
+		return false
+
+	default:
+		if t.handleDirectoryEvent(data) {
+			return true
+		}
+
+		// Ignore other events..
+		// fmt.Printf("Unexpected: %v\n", data)
 	}
+	return true
 }
 
-func (t *Team) PostMessage(string, channelName string, msg string) (bool, error) {
-	return postMessage(t.name, channelName, msg)
+// Stop disconnects the running RTM or Socket Mode connection.
+// A team stopped before it has connected does not connect.
+func (t *Team) Stop() error {
+	t.mu.Lock()
+	cancel, stop := t.cancel, t.stop
+	t.cancel, t.stop = nil, nil
+	t.mu.Unlock()
+
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	if stop == nil {
+		return nil
+	}
+	if err := stop(); err != nil && err != slack.ErrAlreadyDisconnected {
+		return errors.Wrap(err, "failed disconnect")
+	}
+	return nil
 }
 
-func (c *Channel) PostMessage(msg string) (bool, error) {
-	return postMessage(c.teamName, c.name, msg)
+// begin marks the team running and returns the context of the new run,
+// which Stop cancels. It returns false when the team is already running.
+func (t *Team) begin() (context.Context, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cancel != nil {
+		return nil, false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.cancel = cancel
+	return ctx, true
 }
 
-func postMessage(teamName string, channelName string, msg string) (bool, error) {
-	team, ok := teams[teamName]
-	if !ok {
-		log.Debug().Msgf("failed find team %s", teamName)
-		return false, nil
+// setStop sets how to close the connection of the run ctx.
+// It returns false when the run has been stopped already.
+func (t *Team) setStop(ctx context.Context, stop func() error) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ctx.Err() != nil {
+		return false
 	}
-	channel, ok := team.channels[channelName]
-	if !ok {
-		log.Debug().Msgf("failed find channel %s", channelName)
-		return false, nil
+	t.stop = stop
+	return true
+}
+
+// end marks the team stopped when the connection of the run ctx ended
+// without Stop, e.g. on invalid auth.
+func (t *Team) end(ctx context.Context) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ctx.Err() != nil {
+		// Stop reset the state, which may belong to a new run now
+		return
 	}
+	t.cancel()
+	t.cancel, t.stop = nil, nil
+}
 
-	if _, _, err := team.client.PostMessage(
-		channel.id,
-		slack.MsgOptionText(msg, false)); err != nil {
-		return false, errors.Wrap(err, "failed post message")
+func (t *Team) running() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cancel != nil
+}
+
+// channelName returns the channel name, or the id when the channel is unknown.
+func (t *Team) channelName(id string) string {
+	if c := t.channelByID(id); c != nil {
+		return c.name
 	}
+	return id
+}
 
-	log.Debug().
-		Str("team", team.name).
-		Str("channel", channel.name).
-		Str("text", msg).
-		Msg("post message")
+func (t *Team) channel(name string) *Channel {
+	t.chmu.RLock()
+	defer t.chmu.RUnlock()
+	return t.channels[name]
+}
+
+func (t *Team) channelByID(id string) *Channel {
+	t.chmu.RLock()
+	defer t.chmu.RUnlock()
+	return t.channelID[id]
+}
+
+// addChannel registers the channel. A name already used by another channel
+// gets the channel id appended.
+func (t *Team) addChannel(c *Channel) {
+	t.chmu.Lock()
+	defer t.chmu.Unlock()
+	t.addChannelLocked(c)
+}
+
+// addChannelLocked registers c, which must be a new value no other goroutine holds,
+// because its name may still be changed here.
+func (t *Team) addChannelLocked(c *Channel) {
+	if old, ok := t.channelID[c.id]; ok {
+		delete(t.channels, old.name)
+	}
+	if other, ok := t.channels[c.name]; ok && other.id != c.id {
+		c.name = fmt.Sprintf("%s(%s)", c.name, c.id)
+	}
+	t.channels[c.name] = c
+	t.channelID[c.id] = c
+}
+
+// channelIDs returns the ids of the registered channels.
+func (t *Team) channelIDs() map[string]bool {
+	t.chmu.RLock()
+	defer t.chmu.RUnlock()
+	ids := map[string]bool{}
+	for id := range t.channelID {
+		ids[id] = true
+	}
+	return ids
+}
+
+// setChannels replaces the channels of the team with chs, which were fetched
+// while the channels in known were registered. Channels registered since then,
+// e.g. joined during a refresh, are kept, and known channels keep their read state.
+func (t *Team) setChannels(chs []*Channel, known map[string]bool) {
+	t.chmu.Lock()
+	defer t.chmu.Unlock()
+	old := t.channelID
+	t.channels = map[string]*Channel{}
+	t.channelID = map[string]*Channel{}
+	for _, c := range chs {
+		if o, ok := old[c.id]; ok {
+			c.read = o.readState()
+		}
+		t.addChannelLocked(c)
+	}
+	for id, c := range old {
+		if known[id] {
+			continue
+		}
+		if _, ok := t.channelID[id]; !ok {
+			t.channels[c.name] = c
+			t.channelID[id] = c
+		}
+	}
+}
+
+// removeChannel reports whether the channel was registered.
+func (t *Team) removeChannel(id string) bool {
+	t.chmu.Lock()
+	defer t.chmu.Unlock()
+	c, ok := t.channelID[id]
+	if !ok {
+		return false
+	}
+	delete(t.channelID, id)
+	if t.channels[c.name] == c {
+		delete(t.channels, c.name)
+	}
+	return true
+}
 
-	return true, nil
+func (t *Team) PostMessage(string, channelName string, msg string, options ...slack.MsgOption) (string, error) {
+	return postMessage(t.name, channelName, msg, options...)
 }
 
-func GetConversationHistory(teamName string, channelName string) ([]*Message, error) {
+func (c *Channel) PostMessage(msg string, options ...slack.MsgOption) (string, error) {
+	return postMessage(c.teamName, c.name, msg, options...)
+}
+
+func (t *Team) UpdateMessage(channelName string, ts string, msg string) error {
+	if err := t.online(); err != nil {
+		return err
+	}
+	c := t.channel(channelName)
+	if c == nil {
+		return errors.Errorf("failed find channel %s", channelName)
+	}
+	if _, _, _, err := t.client.UpdateMessage(c.id, ts, slack.MsgOptionText(msg, false)); err != nil {
+		return errors.Wrap(err, "failed update message")
+	}
+	return nil
+}
+
+func (t *Team) DeleteMessage(channelName string, ts string) error {
+	if err := t.online(); err != nil {
+		return err
+	}
+	c := t.channel(channelName)
+	if c == nil {
+		return errors.Errorf("failed find channel %s", channelName)
+	}
+	if _, _, err := t.client.DeleteMessage(c.id, ts); err != nil {
+		return errors.Wrap(err, "failed delete message")
+	}
+	return nil
+}
+
+func findChannel(teamName string, channelName string) (*Team, *Channel) {
 	team, ok := teams[teamName]
 	if !ok {
 		log.Debug().Msgf("failed find team %s", teamName)
 		return nil, nil
 	}
-	channel, ok := team.channels[channelName]
-	if !ok {
+	channel := team.channel(channelName)
+	if channel == nil {
 		log.Debug().Msgf("failed find channel %s", channelName)
 		return nil, nil
 	}
-	res, err := team.client.GetConversationHistory(&slack.GetConversationHistoryParameters{
-		ChannelID: channel.id,
+	return team, channel
+}
+
+// postMessage returns the timestamp of the posted message.
+func postMessage(teamName string, channelName string, msg string, options ...slack.MsgOption) (string, error) {
+	team, channel := findChannel(teamName, channelName)
+	if channel == nil {
+		return "", errors.Errorf("failed find channel %s", channelName)
+	}
+	if err := team.online(); err != nil {
+		return "", err
+	}
+
+	options = append([]slack.MsgOption{slack.MsgOptionText(msg, false)}, options...)
+	// posting twice duplicates the message, so only rate limited posts are retried
+	var ts string
+	err := team.retryNow("chat.postMessage", false, func() error {
+		var err error
+		_, ts, err = team.client.PostMessage(channel.id, options...)
+		return err
 	})
 	if err != nil {
-		return nil, errors.Wrap(err, "")
+		return "", errors.Wrap(err, "failed post message")
 	}
 
-	var msgs []*Message
-	for _, m := range res.Messages {
-		msgs = append(msgs, &Message{
-			timestamp: m.Timestamp,
-			user:      team.users[m.User].name,
-			text:      m.Text,
-		})
-	}
+	log.Debug().
+		Str("team", team.name).
+		Str("channel", channel.name).
+		Str("ts", ts).
+		Str("text", msg).
+		Msg("post message")
 
-	return msgs, nil
+	return ts, nil
 }
 
 func init() {
 	viper.SetDefault("slack", "true")
+	viper.SetDefault("slack.event_queue_size", 1000)
+	viper.SetDefault("slack.history_limit", 100)
+	viper.SetDefault("slack.inbox_size", 500)
+	viper.SetDefault("slack.cache", true)
+	viper.SetDefault("slack.archive", false)
+	viper.SetDefault("slack.archive_backfill_limit", 1000)
+	viper.SetDefault("slack.retry_max", 5)
+	viper.SetDefault("slack.retry_backoff", time.Second)
+	viper.SetDefault("slack.retry_max_wait", 10*time.Second)
 	teams = map[string]*Team{}
+	events = newEventQueue(viper.GetInt("slack.event_queue_size"))
+	inbox = newMessageInbox(viper.GetInt("slack.inbox_size"))
 }
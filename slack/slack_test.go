@@ -1,15 +1,1517 @@
 package slack
 
 import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/rs/zerolog/log"
+	"github.com/slack-go/slack"
+	"github.com/spf13/viper"
 )
 
 func TestConnectSlack(t *testing.T) {
-	connectSlack("")
+	tokens := slackTokens()
+	if len(tokens) == 0 {
+		t.Skip("slack.tokens is not configured")
+	}
+	if _, err := initSlack(tokens...); err != nil {
+		t.Fatal(err)
+	}
 	team := GetTeam("pyspa")
-	team.StartRTM(func(i int, a ...string) {
-		log.Debug().Msgf("%v", a)
+	ctx, _ := team.begin()
+	team.StartRTM(ctx, func(ev *Event) {
+		log.Debug().Msgf("%v", ev)
 	})
 }
+
+func TestEventQueue(t *testing.T) {
+	q := newEventQueue(2)
+	for _, text := range []string{"a", "b", "c"} {
+		q.push(&Event{eventType: EventMessage, text: text})
+	}
+	evs := q.drain()
+	if len(evs) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(evs))
+	}
+	if evs[0].text != "b" || evs[1].text != "c" {
+		t.Errorf("expected oldest event dropped, got %v %v", evs[0].text, evs[1].text)
+	}
+	if len(q.drain()) != 0 {
+		t.Error("expected queue empty after drain")
+	}
+}
+
+func TestStartStop(t *testing.T) {
+	team := newTestTeam()
+	ctx, ok := team.begin()
+	if !ok || !team.running() {
+		t.Fatal("expected team running after begin")
+	}
+	if _, ok := team.begin(); ok {
+		t.Error("expected second begin refused while running")
+	}
+
+	// stopped before the connection is up
+	if err := team.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if team.running() {
+		t.Error("expected team stopped")
+	}
+	if team.setStop(ctx, func() error { return nil }) {
+		t.Error("expected stopped run not to connect")
+	}
+
+	// a new run is not reset by the old one ending
+	next, ok := team.begin()
+	if !ok {
+		t.Fatal("expected begin after stop")
+	}
+	team.end(ctx)
+	if !team.running() {
+		t.Error("expected old run not to stop the new one")
+	}
+
+	// the connection ended by itself
+	team.end(next)
+	if team.running() {
+		t.Error("expected team stopped after its run ended")
+	}
+}
+
+func TestDecodeInnerEvent(t *testing.T) {
+	payload := []byte(`{"type":"event_callback","event":{"type":"message","channel":"C1","user":"U1","text":"hi","ts":"1.2"}}`)
+	data, err := decodeInnerEvent(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev, ok := data.(*slack.MessageEvent)
+	if !ok {
+		t.Fatalf("expected *slack.MessageEvent, got %T", data)
+	}
+	if ev.Channel != "C1" || ev.User != "U1" || ev.Text != "hi" || ev.Timestamp != "1.2" {
+		t.Errorf("unexpected message %+v", ev.Msg)
+	}
+
+	data, err = decodeInnerEvent([]byte(`{"type":"event_callback","event":{"type":"unknown_event"}}`))
+	if err != nil || data != nil {
+		t.Errorf("expected nil for unknown event, got %v %v", data, err)
+	}
+}
+
+func TestNewChannelNamesDirectMessages(t *testing.T) {
+	team := newTestTeam()
+	team.userID = "U0"
+	team.addUser(&User{id: "U0", name: "me"})
+	team.addUser(&User{id: "U1", name: "alice"})
+	team.addUser(&User{id: "U2", name: "bob"})
+
+	im := &slack.Channel{}
+	im.ID = "D1"
+	im.IsIM = true
+	im.User = "U1"
+	c, err := team.newChannel(im)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.name != "@alice" {
+		t.Errorf("expected @alice, got %s", c.name)
+	}
+
+	mpim := &slack.Channel{}
+	mpim.ID = "G1"
+	mpim.IsMpIM = true
+	mpim.Members = []string{"U0", "U1", "U2"}
+	c, err = team.newChannel(mpim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.name != "@alice,@bob" {
+		t.Errorf("expected @alice,@bob, got %s", c.name)
+	}
+}
+
+func TestFindUser(t *testing.T) {
+	team := newTestTeam()
+	su := &slack.User{ID: "U1", Name: "alice", RealName: "Alice Liddell"}
+	su.Profile.DisplayName = "ali"
+	team.addUser(newUser(su))
+	team.addUser(&User{id: "U2", name: "bob"})
+
+	for _, name := range []string{"U1", "alice", "@alice", "ali", "Alice Liddell"} {
+		if u := team.findUser(name); u == nil || u.id != "U1" {
+			t.Errorf("findUser(%q) = %v", name, u)
+		}
+	}
+	if u := team.findUser("carol"); u != nil {
+		t.Errorf("unexpected user %v", u)
+	}
+
+	got, err := team.Compose("@alice @ali @Alice Liddell @bob", FormatMarkdown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "<@U1> <@U1> <@U1> <@U2>"; got != want {
+		t.Errorf("Compose = %q, want %q", got, want)
+	}
+}
+
+func TestFormatText(t *testing.T) {
+	team := newTestTeam()
+	team.addUser(&User{id: "U1", name: "alice"})
+	team.addChannel(&Channel{id: "C1", name: "general"})
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"hi <@U1>", "hi @alice"},
+		{"<@U9|bob> see <#C1>", "@bob see #general"},
+		{"<#C9|random>", "#random"},
+		{"<!here> <!channel>", "@here @channel"},
+		{"<!subteam^S1|@devs>", "@devs"},
+		{"<https://example.com|example>", "[[https://example.com][example]]"},
+		{"<https://example.com>", "[[https://example.com]]"},
+		{"<mailto:a@example.com|a@example.com>", "[[mailto:a@example.com]]"},
+		{"a &lt;b&gt; &amp; c", "a <b> & c"},
+	}
+	for _, tt := range tests {
+		if got := team.formatText(tt.in); got != tt.want {
+			t.Errorf("formatText(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCompose(t *testing.T) {
+	team := newTestTeam()
+	team.addUser(&User{id: "U1", name: "alice"})
+	team.addUser(&User{id: "U2", name: "Taro Yamada"})
+	team.addChannel(&Channel{id: "C1", name: "general"})
+
+	tests := []struct {
+		format string
+		in     string
+		want   string
+	}{
+		{FormatOrg, "*bold* /italic/ +strike+ =code=", "*bold* _italic_ ~strike~ `code`"},
+		{FormatOrg, "see [[https://example.com][example]] and [[https://example.org]]", "see <https://example.com|example> and <https://example.org>"},
+		{FormatOrg, "* Heading\n- item\n  - nested\n1. first", "*Heading*\n• item\n  • nested\n1. first"},
+		{FormatOrg, "#+TITLE: memo\n#+begin_src go\na := <-ch && ok\n#+end_src", "```\na := &lt;-ch &amp;&amp; ok\n```"},
+		{FormatOrg, "hi @alice and @Taro Yamada in #general, @here", "hi <@U1> and <@U2> in <#C1>, <!here>"},
+		{FormatMarkdown, "**bold** *italic* ~~strike~~ `a<b`", "*bold* _italic_ ~strike~ `a&lt;b`"},
+		{FormatMarkdown, "# Title\n* item\n2) second\n[label](https://example.com)", "*Title*\n• item\n2. second\n<https://example.com|label>"},
+		{FormatMarkdown, "```\n*raw*\n```", "```\n*raw*\n```"},
+		{FormatMarkdown, "mail@alice @bob", "mail@alice @bob"},
+	}
+	for _, tt := range tests {
+		got, err := team.Compose(tt.in, tt.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Compose(%q, %s) = %q, want %q", tt.in, tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestUniquePath(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "log.txt")
+	if got := uniquePath(p); got != p {
+		t.Errorf("expected %s, got %s", p, got)
+	}
+	if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := uniquePath(p), filepath.Join(dir, "log-1.txt"); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestTrackUnread(t *testing.T) {
+	team := newTestTeam()
+	team.userID = "U0"
+	c := &Channel{id: "C1", name: "general"}
+	c.read.lastRead = "100.000100"
+	team.addChannel(c)
+
+	msg := func(user string, ts string, threadTS string) *slack.MessageEvent {
+		ev := &slack.MessageEvent{}
+		ev.Channel = "C1"
+		ev.User = user
+		ev.Timestamp = ts
+		ev.ThreadTimestamp = threadTS
+		return ev
+	}
+	team.trackUnread(msg("U1", "99.000000", ""))
+	team.trackUnread(msg("U1", "100.000200", ""))
+	team.trackUnread(msg("U1", "101.000000", ""))
+	team.trackUnread(msg("U1", "102.000000", "101.000000"))
+	if rs := c.readState(); rs.unreadCount != 2 || rs.latest != "101.000000" {
+		t.Errorf("unexpected read state %+v", rs)
+	}
+
+	team.trackUnread(msg("U0", "103.000000", ""))
+	if rs := c.readState(); rs.unreadCount != 0 || rs.lastRead != "103.000000" {
+		t.Errorf("expected read after own message, got %+v", rs)
+	}
+}
+
+func TestTSAfter(t *testing.T) {
+	if !tsAfter("1600000000.000100", "1600000000.000099") {
+		t.Error("expected later fraction to be after")
+	}
+	if tsAfter("999999999.9", "1600000000.0") {
+		t.Error("expected shorter seconds to be before")
+	}
+	if !tsAfter("1.0", "") || tsAfter("", "") {
+		t.Error("unexpected comparison with empty ts")
+	}
+}
+
+func TestNewSearchResult(t *testing.T) {
+	team := newTestTeam()
+	team.addChannel(&Channel{id: "C1", name: "general"})
+	team.addUser(&User{id: "U1", name: "Alice"})
+
+	r := team.newSearchResult(&slack.SearchMessage{
+		Channel:   slack.CtxChannel{ID: "C1", Name: "C1"},
+		User:      "U1",
+		Timestamp: "1.000001",
+		Text:      "deploy \ue000done\ue001 by <@U1>",
+	})
+	if r.Channel != "general" || r.User != "Alice" {
+		t.Errorf("unexpected result %+v", r)
+	}
+	if r.Snippet != "deploy *done* by @Alice" {
+		t.Errorf("unexpected snippet %q", r.Snippet)
+	}
+}
+
+func TestTeamCache(t *testing.T) {
+	viper.Set("slack.cache_dir", t.TempDir())
+	defer viper.Set("slack.cache_dir", "")
+
+	newTeam := func() *Team {
+		// the name is restored from the cache
+		team := newTestTeam()
+		team.name = ""
+		team.token = "xoxp-test"
+		return team
+	}
+	team := newTeam()
+	team.name = "test"
+	team.userID = "U0"
+	team.addUser(&User{id: "U1", name: "Alice"})
+	team.addChannel(&Channel{id: "C1", name: "general"})
+	team.addChannel(&Channel{id: "D1", name: "@Alice", isIM: true, userIDs: []string{"U1"}})
+	if err := team.saveCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	cached := newTeam()
+	if !cached.loadCache() {
+		t.Fatal("expected cache to be loaded")
+	}
+	if cached.name != "test" || cached.userID != "U0" || cached.userName("U1") != "Alice" {
+		t.Errorf("unexpected team %s %s", cached.name, cached.userID)
+	}
+	if c := cached.channel("@Alice"); c == nil || !c.isIM || c.userIDs[0] != "U1" {
+		t.Errorf("unexpected channel %+v", c)
+	}
+
+	ch := slack.Channel{}
+	ch.ID = "C2"
+	ch.Name = "random"
+	cached.handleDirectoryEvent(&slack.ChannelJoinedEvent{Channel: ch})
+	cached.handleDirectoryEvent(&slack.ChannelRenameEvent{Channel: slack.ChannelRenameInfo{ID: "C1", Name: "lobby"}})
+	cached.handleDirectoryEvent(&slack.UserChangeEvent{User: slack.User{ID: "U1", Name: "alice", RealName: "Alice Liddell"}})
+
+	reloaded := newTeam()
+	if !reloaded.loadCache() {
+		t.Fatal("expected cache to be loaded")
+	}
+	if reloaded.channel("random") == nil || reloaded.channel("lobby") == nil || reloaded.channel("general") != nil {
+		t.Error("expected channel events to update the cache")
+	}
+	if got := reloaded.userName("U1"); got != "Alice Liddell" {
+		t.Errorf("expected updated user name, got %s", got)
+	}
+}
+
+func TestMessageUser(t *testing.T) {
+	team := newTestTeam()
+	team.addUser(&User{id: "U1", name: "Alice"})
+	team.addBot("B2", "deploy")
+
+	tests := []struct {
+		msg  slack.Msg
+		id   string
+		name string
+	}{
+		{slack.Msg{User: "U1"}, "U1", "Alice"},
+		{slack.Msg{User: "W9", Username: "bob"}, "W9", "bob"},
+		{slack.Msg{User: "W9"}, "W9", "W9"},
+		{slack.Msg{BotID: "B1", BotProfile: &slack.BotProfile{Name: "ci"}}, "B1", "ci"},
+		{slack.Msg{BotID: "B1", Username: "webhook"}, "B1", "webhook"},
+		{slack.Msg{BotID: "B2"}, "B2", "deploy"},
+		{slack.Msg{BotID: "B3"}, "B3", "B3"},
+		{slack.Msg{}, "", ""},
+	}
+	for _, tt := range tests {
+		id, name := team.messageUser(&tt.msg)
+		if id != tt.id || name != tt.name {
+			t.Errorf("expected %s %s, got %s %s", tt.id, tt.name, id, name)
+		}
+	}
+
+	var got *Event
+	team.handleEvent(&slack.MessageEvent{Msg: slack.Msg{Channel: "C1", SubType: "bot_message", BotID: "B3", Text: "hi"}}, func(ev *Event) {
+		got = ev
+	})
+	if got == nil || got.message.user != "B3" {
+		t.Errorf("expected bot message event, got %+v", got)
+	}
+}
+
+func TestRenderMessage(t *testing.T) {
+	team := newTestTeam()
+	team.addUser(&User{id: "U1", name: "Alice"})
+
+	var m slack.Msg
+	data := `{
+		"text": "Build failed",
+		"blocks": [
+			{"type": "header", "text": {"type": "plain_text", "text": "CI"}},
+			{"type": "section", "text": {"type": "mrkdwn", "text": "Build *failed* by <@U1>"},
+			 "fields": [{"type": "mrkdwn", "text": "branch: main"}]},
+			{"type": "context", "elements": [{"type": "mrkdwn", "text": "job 42"}]},
+			{"type": "rich_text", "elements": [
+				{"type": "rich_text_list", "style": "ordered", "elements": [
+					{"type": "rich_text_section", "elements": [{"type": "text", "text": "lint"}]},
+					{"type": "rich_text_section", "elements": [{"type": "user", "user_id": "U1"}]}
+				]},
+				{"type": "rich_text_preformatted", "elements": [{"type": "text", "text": "exit 1"}]}
+			]}
+		],
+		"attachments": [
+			{"color": "danger", "title": "Logs", "title_link": "https://ci.example.com/42",
+			 "text": "see logs", "fields": [{"title": "Status", "value": "failed"}]},
+			{"fallback": "fallback only"}
+		]
+	}`
+	if err := json.Unmarshal([]byte(data), &m); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "CI\nBuild *failed* by @Alice\nbranch: main\njob 42\n1. lint\n2. @Alice\n```\nexit 1\n```"
+	if got := team.renderText(&m); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	atts := team.renderAttachments(m.Attachments)
+	if len(atts) != 2 {
+		t.Fatalf("expected 2 attachments, got %d", len(atts))
+	}
+	if atts[0].color != "danger" || atts[0].text != "[[https://ci.example.com/42][Logs]]\nsee logs\nStatus: failed" {
+		t.Errorf("unexpected attachment %+v", atts[0])
+	}
+	if atts[1].text != "fallback only" {
+		t.Errorf("unexpected attachment %+v", atts[1])
+	}
+
+	rich := slack.Msg{Text: "hi <@U1>"}
+	rich.Blocks = slack.Blocks{BlockSet: []slack.Block{slack.NewRichTextBlock("b")}}
+	if got := team.renderText(&rich); got != "hi @Alice" {
+		t.Errorf("expected text of a user message, got %q", got)
+	}
+}
+
+func TestMessageArchive(t *testing.T) {
+	a, err := newMessageArchive(filepath.Join(t.TempDir(), "archive.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	msgs := []*Message{
+		{timestamp: "100.000001", channel: "general", user: "Alice", text: "Deploy started"},
+		{timestamp: "101.000001", channel: "general", user: "Bob", text: "deploy finished", attachments: []*Attachment{{text: "build 42"}}},
+		{timestamp: "102.000001", channel: "general", user: "Bob", text: "lunch"},
+	}
+	if err := a.store("test", "C1", msgs); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.store("other", "C9", []*Message{{timestamp: "103.000001", text: "deploy elsewhere"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	hits, err := a.search("test", "DEPLOY", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 2 || hits[0].message.timestamp != "101.000001" || hits[1].team != "test" {
+		t.Errorf("unexpected hits %+v", hits)
+	}
+	if hits, _ := a.search("", "deploy", 0); len(hits) != 3 {
+		t.Errorf("expected hits of all teams, got %d", len(hits))
+	}
+	if hits, _ := a.search("test", "deploy 42", 0); len(hits) != 1 {
+		t.Errorf("expected attachment text to be searched, got %d", len(hits))
+	}
+
+	if err := a.remove("test", "C1", "101.000001"); err != nil {
+		t.Fatal(err)
+	}
+	if hits, _ := a.search("test", "deploy", 0); len(hits) != 1 {
+		t.Errorf("expected removed message not to be found, got %d", len(hits))
+	}
+
+	if ts, err := a.backfillCursor("test", "C1"); err != nil || ts != "" {
+		t.Errorf("expected no backfill cursor, got %q %v", ts, err)
+	}
+	if err := a.setBackfillCursor("test", "C1", "102.000001"); err != nil {
+		t.Fatal(err)
+	}
+	if ts, _ := a.backfillCursor("test", "C1"); ts != "102.000001" {
+		t.Errorf("unexpected backfill cursor %q", ts)
+	}
+	if hits, _ := a.search("test", "", 0); len(hits) != 2 {
+		t.Errorf("expected backfill cursor not to be searched, got %d", len(hits))
+	}
+}
+
+func writeTestZip(t *testing.T, p string, files map[string]string) {
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBrokenExport(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "broken.zip")
+	writeTestZip(t, p, map[string]string{
+		"users.json": `[{"id": "U1"`,
+	})
+	if _, err := openExport(p); err == nil {
+		t.Fatal("expected error for broken users.json")
+	}
+	if GetTeam("broken") != nil {
+		t.Error("broken export registered")
+	}
+}
+
+func TestExportTeam(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "old.zip")
+	writeTestZip(t, p, map[string]string{
+		"users.json":    `[{"id": "U1", "name": "alice", "real_name": "Alice"}, {"id": "U2", "name": "bob"}]`,
+		"channels.json": `[{"id": "C1", "name": "general", "members": ["U1", "U2"]}]`,
+		"dms.json":      `[{"id": "D1", "members": ["U1", "U2"]}]`,
+		"general/2020-01-02.json": `[
+			{"type": "message", "user": "U2", "text": "second", "ts": "1577923200.000100"},
+			{"type": "message", "user": "U1", "text": "reply", "ts": "1577923300.000100", "thread_ts": "1577836800.000100"}
+		]`,
+		"general/2020-01-01.json": `[{"type": "message", "user": "U1", "text": "hello <@U2>", "ts": "1577836800.000100", "thread_ts": "1577836800.000100"}]`,
+		"D1/2020-01-01.json":      `[{"type": "message", "user": "U2", "text": "hi", "ts": "1577836900.000100"}]`,
+	})
+
+	team, err := openExport(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delete(teams, team.name)
+	if GetTeam("old") != team || len(team.GetChannels()) != 2 {
+		t.Fatalf("expected export team with 2 channels")
+	}
+
+	msgs, err := GetConversationHistory("old", "general", &HistoryParameters{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].text != "hello @bob" || msgs[0].user != "Alice" || msgs[1].text != "second" {
+		t.Errorf("unexpected history %+v", msgs)
+	}
+	msgs, _ = GetConversationHistory("old", "general", &HistoryParameters{Limit: 1})
+	if len(msgs) != 1 || msgs[0].text != "second" {
+		t.Errorf("expected latest message, got %+v", msgs)
+	}
+	replies, err := GetConversationReplies("old", "general", "1577836800.000100")
+	if err != nil || len(replies) != 2 {
+		t.Errorf("unexpected replies %+v %v", replies, err)
+	}
+	if msgs, _ := GetConversationHistory("old", "@Alice,@bob", nil); len(msgs) != 1 {
+		t.Errorf("expected direct message history, got %+v", msgs)
+	}
+
+	if _, err := postMessage("old", "general", "hi"); err == nil {
+		t.Error("expected posting to an export to fail")
+	}
+	if err := team.AddReaction("general", "1577836800.000100", "+1"); err == nil {
+		t.Error("expected reacting in an export to fail")
+	}
+}
+
+func TestPresenceAndDNDEvents(t *testing.T) {
+	team := newTestTeam()
+	team.addUser(&User{id: "U1", name: "Alice"})
+	team.addUser(&User{id: "U2", name: "Bob"})
+	team.addChannel(&Channel{id: "D1", name: "@Alice", isIM: true, userIDs: []string{"U1"}})
+	team.addChannel(&Channel{id: "G1", name: "@Alice,@Bob", isMpIM: true, userIDs: []string{"U1", "U2"}})
+
+	if ids := team.presenceUsers(); len(ids) != 1 || ids[0] != "U1" {
+		t.Errorf("unexpected presence users %v", ids)
+	}
+
+	var got []*Event
+	callback := func(ev *Event) {
+		got = append(got, ev)
+	}
+	team.handleEvent(&slack.PresenceChangeEvent{Presence: "away", Users: []string{"U1", "U2"}}, callback)
+	team.handleEvent(&slack.DNDUpdatedEvent{User: "U1", Status: slack.DNDStatus{Enabled: true}}, callback)
+	if len(got) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(got))
+	}
+	if p := got[1].presence; got[1].eventType != EventPresenceChange || p.user != "Bob" || p.presence != "away" {
+		t.Errorf("unexpected presence event %+v", p)
+	}
+	if d := got[2].dnd; got[2].eventType != EventDNDUpdated || d.user != "Alice" || !d.enabled {
+		t.Errorf("unexpected dnd event %+v", d)
+	}
+}
+
+func TestChannelManagement(t *testing.T) {
+	viper.Set("slack.cache", false)
+	defer viper.Set("slack.cache", true)
+
+	calls := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls[r.URL.Path]++
+		switch r.URL.Path {
+		case "/conversations.list":
+			w.Write([]byte(`{"ok": true, "channels": [
+				{"id": "C1", "name": "general", "is_channel": true, "is_member": true},
+				{"id": "C2", "name": "random", "is_channel": true, "num_members": 3}
+			]}`))
+		case "/conversations.join":
+			if calls[r.URL.Path] == 1 {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Write([]byte(`{"ok": true, "channel": {"id": "C2", "name": "random", "is_channel": true, "is_member": true}}`))
+		case "/conversations.create":
+			w.Write([]byte(`{"ok": true, "channel": {"id": "G1", "name": "` + r.FormValue("name") + `", "is_private": true}}`))
+		case "/conversations.leave":
+			w.Write([]byte(`{"ok": true}`))
+		default:
+			t.Errorf("unexpected call %s", r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+
+	team := newTestTeam()
+	team.setClient(srv.URL + "/")
+	team.addChannel(&Channel{id: "C1", name: "general"})
+
+	chs, err := team.JoinableChannels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chs) != 1 || chs[0].Name != "random" || chs[0].NumMembers != 3 {
+		t.Errorf("unexpected joinable channels %+v", chs)
+	}
+
+	if _, err := team.JoinChannel("random"); err != nil {
+		t.Fatal(err)
+	}
+	if c := team.channel("random"); c == nil || c.id != "C2" {
+		t.Errorf("expected joined channel to be registered, got %+v", c)
+	}
+	if _, err := team.CreateChannel("secret", true); err != nil {
+		t.Fatal(err)
+	}
+	if team.channelByID("G1") == nil {
+		t.Error("expected created channel to be registered")
+	}
+	if err := team.LeaveChannel("random"); err != nil {
+		t.Fatal(err)
+	}
+	if team.channel("random") != nil {
+		t.Error("expected left channel to be removed")
+	}
+	if _, err := team.JoinChannel("random"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := team.JoinChannel("missing"); err == nil {
+		t.Error("expected error for unknown channel")
+	}
+	// joins resolve the id from the fetched list, missing is looked up again
+	if calls["/conversations.list"] != 2 || calls["/conversations.join"] != 3 {
+		t.Errorf("unexpected calls %v", calls)
+	}
+}
+
+func TestChannelInfo(t *testing.T) {
+	viper.Set("slack.cache_dir", t.TempDir())
+	defer viper.Set("slack.cache_dir", "")
+
+	team := newTestTeam()
+	for _, name := range []string{"random", "general", "dev"} {
+		ch := &slack.Channel{}
+		ch.ID = "C" + name
+		ch.Name = name
+		ch.NumMembers = 2
+		ch.Topic.Value = "about " + name
+		c, err := team.newChannel(ch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		team.addChannel(c)
+	}
+
+	var names []string
+	for _, c := range team.SortedChannels() {
+		names = append(names, c.name)
+	}
+	if strings.Join(names, ",") != "dev,general,random" {
+		t.Errorf("unexpected order %v", names)
+	}
+
+	ev := &slack.MessageEvent{}
+	ev.Channel = "Cdev"
+	ev.SubType = "channel_topic"
+	ev.Topic = "deploys"
+	team.updateChannelInfo(ev)
+	ev.SubType = "channel_join"
+	team.updateChannelInfo(ev)
+	if info := team.channel("dev").channelInfo(); info.topic != "deploys" || info.numMembers != 3 {
+		t.Errorf("unexpected channel info %+v", info)
+	}
+}
+
+func TestUserDirectory(t *testing.T) {
+	team := newTestTeam()
+	su := &slack.User{ID: "U1", Name: "alice", RealName: "Alice", TZ: "Asia/Tokyo", TZOffset: 9 * 60 * 60}
+	su.Profile.DisplayName = "ali"
+	su.Profile.Title = "SRE"
+	team.addUser(newUser(su))
+	team.addUser(&User{id: "U2", name: "Bob", tz: "Nowhere/Unknown", tzOffset: -5 * 60 * 60})
+	team.addUser(&User{id: "U0", name: "Bob"})
+
+	users := team.SortedUsers()
+	if len(users) != 3 || users[0].name != "Alice" || users[1].id != "U0" || users[2].id != "U2" {
+		t.Errorf("unexpected order %+v", users)
+	}
+	if u := team.findUser("Alice"); u == nil || u.displayName != "ali" || u.title != "SRE" {
+		t.Errorf("unexpected user %+v", u)
+	}
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if got := team.user("U1").localTime(now).Format("15:04"); got != "09:00" {
+		t.Errorf("expected 09:00 in Tokyo, got %s", got)
+	}
+	if got := team.user("U2").localTime(now).Format("15:04"); got != "19:00" {
+		t.Errorf("expected offset fallback 19:00, got %s", got)
+	}
+}
+
+func TestInbox(t *testing.T) {
+	viper.Set("slack.watch_channels", []string{"work/deploy"})
+	defer viper.Set("slack.watch_channels", nil)
+	inbox = newMessageInbox(3)
+
+	newTeam := func(name string) *Team {
+		team := newTestTeam()
+		team.name = name
+		team.userID = "U0"
+		team.addUser(&User{id: "U1", name: "Alice"})
+		team.addChannel(&Channel{id: "C1", name: "general"})
+		team.addChannel(&Channel{id: "C2", name: "deploy"})
+		team.addChannel(&Channel{id: "D1", name: "@Alice", isIM: true, userIDs: []string{"U1"}})
+		return team
+	}
+	work := newTeam("work")
+	home := newTeam("home")
+
+	msg := func(channel string, user string, ts string, text string) *slack.MessageEvent {
+		ev := &slack.MessageEvent{}
+		ev.Channel = channel
+		ev.User = user
+		ev.Timestamp = ts
+		ev.Text = text
+		return ev
+	}
+	if r := work.inboxReason(msg("C1", "U0", "1.0", "<@U0>")); r != "" {
+		t.Errorf("own message delivered as %s", r)
+	}
+	if r := home.inboxReason(msg("C2", "U1", "1.0", "deployed")); r != "" {
+		t.Errorf("unwatched channel delivered as %s", r)
+	}
+
+	callback := func(*Event) {}
+	work.handleEvent(msg("C1", "U1", "100.000300", "hi <@U0>"), callback)
+	home.handleEvent(msg("D1", "U1", "100.000100", "hello"), callback)
+	home.handleEvent(msg("C1", "U1", "100.000150", "chatter"), callback)
+	work.handleEvent(msg("C2", "U1", "100.000200", "deployed"), callback)
+	home.handleEvent(msg("C1", "U1", "100.000250", "<!here> lunch"), callback)
+
+	var got []string
+	for _, e := range inbox.since("") {
+		got = append(got, e.teamName+"/"+e.message.channel+"/"+e.reason)
+	}
+	want := []string{"work/deploy/watch", "home/general/mention", "work/general/mention"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("unexpected inbox %v", got)
+	}
+	if es := inbox.since("100.000250"); len(es) != 1 || es[0].message.timestamp != "100.000300" {
+		t.Errorf("unexpected entries since %v", es)
+	}
+}
+
+type testSpeaker chan string
+
+func (s testSpeaker) Speak(text string) error {
+	s <- text
+	return nil
+}
+
+func TestRules(t *testing.T) {
+	viper.Set("slack.rules", []map[string]interface{}{
+		{"name": "alerts", "channel": "#alerts", "regex": "(?i)down", "notify": true, "urgent": true},
+		{"mention": true, "speak": true},
+		{"team": "other", "notify": true},
+	})
+	defer viper.Set("slack.rules", nil)
+	if err := loadRules(); err != nil {
+		t.Fatal(err)
+	}
+	defer loadRules()
+	spk := make(testSpeaker, 1)
+	SetSpeaker(spk)
+	defer SetSpeaker(nil)
+
+	team := newTestTeam()
+	team.userID = "U0"
+	team.addUser(&User{id: "U1", name: "Alice"})
+	team.addChannel(&Channel{id: "C1", name: "alerts"})
+	team.addChannel(&Channel{id: "C2", name: "general"})
+
+	handle := func(channel string, user string, text string) []*Event {
+		var got []*Event
+		ev := &slack.MessageEvent{}
+		ev.Channel = channel
+		ev.User = user
+		ev.Timestamp = "1.0"
+		ev.Text = text
+		team.handleEvent(ev, func(ev *Event) {
+			got = append(got, ev)
+		})
+		return got
+	}
+
+	got := handle("C1", "U1", "db is DOWN")
+	if len(got) != 2 || got[0].eventType != EventNotification || got[0].text != "alerts" || !got[0].message.urgent {
+		t.Errorf("unexpected events %+v", got)
+	}
+	if got := handle("C2", "U1", "db is down"); len(got) != 1 || got[0].message.urgent {
+		t.Errorf("unexpected events %+v", got)
+	}
+	if got := handle("C1", "U0", "db is down <@U0>"); len(got) != 1 {
+		t.Errorf("own message matched rules %+v", got)
+	}
+
+	handle("C2", "U1", "<@U0> ping")
+	select {
+	case text := <-spk:
+		if text != "Alice @U0 ping" {
+			t.Errorf("unexpected speech %q", text)
+		}
+	case <-time.After(time.Second):
+		t.Error("mention was not spoken")
+	}
+
+	viper.Set("slack.rules", []map[string]interface{}{{"regex": "("}})
+	if err := loadRules(); err == nil {
+		t.Error("expected error for invalid regex")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	viper.Set("slack.retry_backoff", time.Millisecond)
+	defer viper.Set("slack.retry_backoff", time.Second)
+	viper.Set("slack.retry_max", 2)
+	defer viper.Set("slack.retry_max", 5)
+	events.drain()
+
+	team := newTestTeam()
+	calls := 0
+	fail := func(errs ...error) func() error {
+		calls = 0
+		return func() error {
+			calls++
+			if calls <= len(errs) {
+				return errs[calls-1]
+			}
+			return nil
+		}
+	}
+	serverError := slack.StatusCodeError{Code: http.StatusBadGateway, Status: "502 Bad Gateway"}
+
+	if err := team.retry("op", true, fail(&slack.RateLimitedError{}, serverError)); err != nil || calls != 3 {
+		t.Errorf("expected success after 3 calls, got %d %v", calls, err)
+	}
+	if err := team.retry("op", false, fail(serverError)); err == nil || calls != 1 {
+		t.Errorf("non idempotent call retried on server error, %d calls", calls)
+	}
+	if err := team.retry("op", false, fail(&slack.RateLimitedError{})); err != nil || calls != 2 {
+		t.Errorf("expected rate limited post to be retried, got %d %v", calls, err)
+	}
+	if err := team.retry("op", true, fail(errors.New("invalid_auth"))); err == nil || calls != 1 {
+		t.Errorf("permanent error retried, %d calls", calls)
+	}
+	if err := team.retry("op", true, fail(io.EOF, io.EOF, io.EOF)); err != io.EOF || calls != 3 {
+		t.Errorf("expected to give up after 2 retries, got %d %v", calls, err)
+	}
+	dnsError := &url.Error{Op: "Post", URL: "https://slack.com/api/auth.test", Err: &net.DNSError{Err: "no such host", Name: "slack.com"}}
+	if err := team.retry("op", true, fail(dnsError)); err == nil || calls != 1 {
+		t.Errorf("dns failure retried, %d calls", calls)
+	}
+	timeout := &url.Error{Op: "Post", URL: "https://slack.com/api/auth.test", Err: &net.DNSError{Err: "timeout", Name: "slack.com", IsTimeout: true}}
+	if err := team.retry("op", true, fail(timeout)); err != nil || calls != 2 {
+		t.Errorf("expected timeout to be retried, got %d %v", calls, err)
+	}
+	if evs := events.drain(); len(evs) != 6 || evs[0].eventType != EventProgress {
+		t.Errorf("expected 6 progress events, got %d", len(evs))
+	}
+
+	viper.Set("slack.retry_max_wait", time.Second)
+	defer viper.Set("slack.retry_max_wait", 10*time.Second)
+	if err := team.retryNow("op", false, fail(&slack.RateLimitedError{RetryAfter: time.Minute})); err == nil || calls != 1 {
+		t.Errorf("expected long rate limit to fail at once, got %d %v", calls, err)
+	}
+	if err := team.retryNow("op", true, fail(serverError)); err != nil || calls != 2 {
+		t.Errorf("expected short retry to be done, got %d %v", calls, err)
+	}
+}
+
+func TestGetUsersRetry(t *testing.T) {
+	viper.Set("slack.retry_backoff", time.Millisecond)
+	defer viper.Set("slack.retry_backoff", time.Second)
+
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch {
+		case calls == 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case r.FormValue("cursor") == "":
+			w.Write([]byte(`{"ok": true, "members": [{"id": "U1", "name": "alice"}], "response_metadata": {"next_cursor": "next"}}`))
+		case calls == 3:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte(`{"ok": true, "members": [{"id": "U2", "name": "bob"}]}`))
+		}
+	}))
+	defer srv.Close()
+
+	team := newTestTeam()
+	team.setClient(srv.URL + "/")
+	users, err := team.getUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].ID != "U1" || users[1].ID != "U2" || calls != 4 {
+		t.Errorf("unexpected users %+v after %d calls", users, calls)
+	}
+}
+
+// newTestTeam returns an empty team named "test" which has no client.
+// setClient points it at a test server.
+func newTestTeam() *Team {
+	return &Team{
+		name:      "test",
+		token:     "xoxp-test",
+		channels:  map[string]*Channel{},
+		channelID: map[string]*Channel{},
+		users:     map[string]*User{},
+	}
+}
+
+func TestUploadFile(t *testing.T) {
+	var uploaded string
+	var uploadURL, complete url.Values
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/files.getUploadURLExternal":
+			if r.Header.Get("Authorization") != "Bearer xoxp-test" {
+				t.Errorf("unexpected authorization %s", r.Header.Get("Authorization"))
+			}
+			r.ParseForm()
+			uploadURL = r.Form
+			w.Write([]byte(`{"ok": true, "upload_url": "` + srv.URL + `/upload", "file_id": "F1"}`))
+		case "/upload":
+			b, _ := ioutil.ReadAll(r.Body)
+			uploaded = string(b)
+		case "/files.completeUploadExternal":
+			r.ParseForm()
+			complete = r.Form
+			w.Write([]byte(`{"ok": true, "files": [{"id": "F1", "title": "memo.org"}]}`))
+		default:
+			t.Errorf("unexpected call %s", r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+
+	team := newTestTeam()
+	team.setClient(srv.URL + "/")
+	team.addChannel(&Channel{id: "C1", name: "general"})
+	team.addChannel(&Channel{id: "C2", name: "random"})
+
+	id, err := team.UploadFile(&FileUploadParameters{
+		Content:         "hello",
+		Filename:        "memo.org",
+		Filetype:        "org",
+		InitialComment:  "see",
+		ThreadTimestamp: "1.0",
+		Channels:        []string{"general"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploadURL.Get("filename") != "memo.org" || uploadURL.Get("length") != "5" || uploadURL.Get("snippet_type") != "org" {
+		t.Errorf("unexpected upload url request %v", uploadURL)
+	}
+	if id != "F1" || uploaded != "hello" {
+		t.Errorf("unexpected upload %s %q", id, uploaded)
+	}
+	if complete.Get("channel_id") != "C1" || complete.Get("thread_ts") != "1.0" || complete.Get("initial_comment") != "see" ||
+		complete.Get("files") != `[{"id":"F1","title":"memo.org"}]` {
+		t.Errorf("unexpected complete request %v", complete)
+	}
+
+	if _, err := team.UploadFile(&FileUploadParameters{Content: "a", Filename: "a.txt", Channels: []string{"general", "random"}}); err != nil {
+		t.Fatal(err)
+	}
+	if complete.Get("channels") != "C1,C2" || complete.Get("channel_id") != "" {
+		t.Errorf("unexpected complete request %v", complete)
+	}
+
+	_, err = team.UploadFile(&FileUploadParameters{Content: "a", Filename: "a.txt", ThreadTimestamp: "1.0", Channels: []string{"general", "random"}})
+	if err == nil {
+		t.Error("expected error for thread-ts with two channels")
+	}
+}
+
+func TestGetConversationHistory(t *testing.T) {
+	var limits []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/conversations.history" {
+			t.Errorf("unexpected call %s", r.URL.Path)
+			return
+		}
+		if r.FormValue("channel") != "C1" || r.FormValue("oldest") != "0.5" {
+			t.Errorf("unexpected request %v", r.Form)
+		}
+		limits = append(limits, r.FormValue("limit"))
+		// two messages per page, newest first
+		switch r.FormValue("cursor") {
+		case "":
+			w.Write([]byte(`{"ok": true, "messages": [{"ts": "5.0", "user": "U1", "text": "e"}, {"ts": "4.0", "user": "U1", "text": "d"}],
+				"has_more": true, "response_metadata": {"next_cursor": "p2"}}`))
+		case "p2":
+			w.Write([]byte(`{"ok": true, "messages": [{"ts": "3.0", "user": "U1", "text": "c"}, {"ts": "2.0", "user": "U1", "text": "b"}],
+				"has_more": true, "response_metadata": {"next_cursor": "p3"}}`))
+		case "p3":
+			w.Write([]byte(`{"ok": true, "messages": [{"ts": "1.0", "user": "U1", "text": "a"}], "has_more": false}`))
+		}
+	}))
+	defer srv.Close()
+
+	team := newTestTeam()
+	team.setClient(srv.URL + "/")
+	team.addUser(&User{id: "U1", name: "alice"})
+	team.addChannel(&Channel{id: "C1", name: "general"})
+	teams[team.name] = team
+	defer delete(teams, team.name)
+
+	texts := func(msgs []*Message) string {
+		var res []string
+		for _, m := range msgs {
+			res = append(res, m.text)
+		}
+		return strings.Join(res, "")
+	}
+
+	msgs, err := GetConversationHistory("test", "general", &HistoryParameters{Oldest: "0.5", Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := texts(msgs); got != "cde" || msgs[0].user != "alice" {
+		t.Errorf("expected the latest 3 messages oldest first, got %q", got)
+	}
+	if strings.Join(limits, ",") != "3,1" {
+		t.Errorf("unexpected page limits %v", limits)
+	}
+
+	limits = nil
+	msgs, err = GetConversationHistory("test", "general", &HistoryParameters{Oldest: "0.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := texts(msgs); got != "abcde" || len(limits) != 3 {
+		t.Errorf("expected all messages in 3 pages, got %q in %d", got, len(limits))
+	}
+
+	if _, err := GetConversationHistory("test", "random", nil); err == nil {
+		t.Error("expected error for unknown channel")
+	}
+}
+
+func TestGetConversationReplies(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chat.postMessage" {
+			if r.FormValue("thread_ts") != "1.0" || r.FormValue("reply_broadcast") != "true" {
+				t.Errorf("unexpected post %v", r.Form)
+			}
+			w.Write([]byte(`{"ok": true, "channel": "C1", "ts": "4.0"}`))
+			return
+		}
+		calls++
+		if r.URL.Path != "/conversations.replies" || r.FormValue("channel") != "C1" || r.FormValue("ts") != "1.0" {
+			t.Errorf("unexpected request %s %v", r.URL.Path, r.Form)
+			return
+		}
+		switch r.FormValue("cursor") {
+		case "":
+			w.Write([]byte(`{"ok": true, "messages": [{"ts": "1.0", "thread_ts": "1.0", "reply_count": 2, "text": "parent"},
+				{"ts": "2.0", "thread_ts": "1.0", "text": "first"}], "has_more": true, "response_metadata": {"next_cursor": "p2"}}`))
+		case "p2":
+			w.Write([]byte(`{"ok": true, "messages": [{"ts": "3.0", "thread_ts": "1.0", "text": "second"}], "has_more": false}`))
+		}
+	}))
+	defer srv.Close()
+
+	team := newTestTeam()
+	team.setClient(srv.URL + "/")
+	team.addChannel(&Channel{id: "C1", name: "general"})
+	teams[team.name] = team
+	defer delete(teams, team.name)
+
+	msgs, err := GetConversationReplies("test", "general", "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 || calls != 2 {
+		t.Fatalf("expected 3 messages in 2 pages, got %d in %d", len(msgs), calls)
+	}
+	if msgs[0].text != "parent" || msgs[0].replyCount != 2 || msgs[2].text != "second" || msgs[2].threadTimestamp != "1.0" {
+		t.Errorf("unexpected replies %+v %+v", msgs[0], msgs[2])
+	}
+	if _, err := GetConversationReplies("test", "random", "1.0"); err == nil {
+		t.Error("expected error for unknown channel")
+	}
+
+	ts, err := postMessage("test", "general", "third", slack.MsgOptionTS("1.0"), slack.MsgOptionBroadcast())
+	if err != nil || ts != "4.0" {
+		t.Errorf("unexpected post into thread %s %v", ts, err)
+	}
+}
+
+func TestReactions(t *testing.T) {
+	var calls []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.FormValue("channel") != "C1" || r.FormValue("timestamp") != "1.0" {
+			t.Errorf("unexpected request %s %v", r.URL.Path, r.Form)
+		}
+		calls = append(calls, strings.TrimPrefix(r.URL.Path, "/")+" "+r.FormValue("name"))
+		switch r.URL.Path {
+		case "/reactions.add", "/reactions.remove":
+			w.Write([]byte(`{"ok": true}`))
+		case "/reactions.get":
+			w.Write([]byte(`{"ok": true, "type": "message", "message": {"reactions": [{"name": "+1", "count": 2, "users": ["U1", "U2"]}]}}`))
+		}
+	}))
+	defer srv.Close()
+
+	team := newTestTeam()
+	team.setClient(srv.URL + "/")
+	team.addUser(&User{id: "U1", name: "alice"})
+	team.addUser(&User{id: "U2", name: "bob"})
+	team.addChannel(&Channel{id: "C1", name: "general"})
+
+	if err := team.AddReaction("general", "1.0", ":+1:"); err != nil {
+		t.Fatal(err)
+	}
+	if err := team.RemoveReaction("general", "1.0", "eyes"); err != nil {
+		t.Fatal(err)
+	}
+	reactions, err := team.GetReactions("general", "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "reactions.add +1,reactions.remove eyes,reactions.get "; strings.Join(calls, ",") != want {
+		t.Errorf("unexpected calls %v", calls)
+	}
+	if len(reactions) != 1 || reactions[0].name != "+1" || reactions[0].count != 2 || strings.Join(reactions[0].users, ",") != "alice,bob" {
+		t.Errorf("unexpected reactions %+v", reactions)
+	}
+	if err := team.AddReaction("random", "1.0", "eyes"); err == nil {
+		t.Error("expected error for unknown channel")
+	}
+}
+
+func TestEditMessages(t *testing.T) {
+	var calls []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		calls = append(calls, strings.TrimPrefix(r.URL.Path, "/")+" "+r.FormValue("channel")+" "+r.FormValue("ts")+" "+r.FormValue("text"))
+		switch r.URL.Path {
+		case "/chat.postMessage":
+			w.Write([]byte(`{"ok": true, "channel": "C1", "ts": "1.0"}`))
+		case "/chat.update":
+			w.Write([]byte(`{"ok": true, "channel": "C1", "ts": "1.0", "text": "edited"}`))
+		case "/chat.delete":
+			w.Write([]byte(`{"ok": true, "channel": "C1", "ts": "1.0"}`))
+		}
+	}))
+	defer srv.Close()
+
+	team := newTestTeam()
+	team.setClient(srv.URL + "/")
+	team.addChannel(&Channel{id: "C1", name: "general"})
+	teams[team.name] = team
+	defer delete(teams, team.name)
+
+	ts, err := postMessage("test", "general", "hello")
+	if err != nil || ts != "1.0" {
+		t.Fatalf("expected posted ts, got %q %v", ts, err)
+	}
+	if err := team.UpdateMessage("general", ts, "edited"); err != nil {
+		t.Fatal(err)
+	}
+	if err := team.DeleteMessage("general", ts); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"chat.postMessage C1  hello", "chat.update C1 1.0 edited", "chat.delete C1 1.0 "}
+	if strings.Join(calls, "|") != strings.Join(want, "|") {
+		t.Errorf("unexpected calls %q", calls)
+	}
+	if err := team.DeleteMessage("random", ts); err == nil {
+		t.Error("expected error for unknown channel")
+	}
+	if _, err := postMessage("test", "random", "hello"); err == nil || len(calls) != 3 {
+		t.Error("expected post to unknown channel to fail without a call")
+	}
+}
+
+func TestHiddenMessages(t *testing.T) {
+	team := newTestTeam()
+	team.addChannel(&Channel{id: "C1", name: "general"})
+
+	var got []*Event
+	callback := func(ev *Event) {
+		got = append(got, ev)
+	}
+	ev := &slack.MessageEvent{}
+	ev.Channel = "C1"
+	ev.SubType = "message_replied"
+	ev.Hidden = true
+	team.handleEvent(ev, callback)
+	if len(got) != 0 {
+		t.Errorf("hidden message delivered %+v", got[0])
+	}
+
+	ev = &slack.MessageEvent{}
+	ev.Channel = "C1"
+	ev.SubType = "message_deleted"
+	ev.Hidden = true
+	ev.DeletedTimestamp = "1.0"
+	team.handleEvent(ev, callback)
+	if len(got) != 1 || got[0].eventType != EventMessageDeleted {
+		t.Errorf("expected message deleted event, got %+v", got)
+	}
+}
+
+func TestLoadReadStates(t *testing.T) {
+	limited := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.FormValue("channel") {
+		case "C1":
+			if !limited {
+				limited = true
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Write([]byte(`{"ok": true, "channel": {"id": "C1", "last_read": "1.0", "unread_count_display": 2, "latest": {"ts": "3.0"}}}`))
+		default:
+			w.Write([]byte(`{"ok": false, "error": "channel_not_found"}`))
+		}
+	}))
+	defer srv.Close()
+	events.drain()
+
+	team := newTestTeam()
+	team.setClient(srv.URL + "/")
+	team.addChannel(&Channel{id: "C1", name: "general"})
+	team.addChannel(&Channel{id: "C2", name: "random"})
+	team.loadReadStates()
+
+	if rs := team.channel("general").readState(); rs.lastRead != "1.0" || rs.unreadCount != 2 || rs.latest != "3.0" {
+		t.Errorf("unexpected read state after rate limit %+v", rs)
+	}
+	var errs []string
+	for _, ev := range events.drain() {
+		if ev.eventType == EventError {
+			errs = append(errs, ev.text)
+		}
+	}
+	if len(errs) != 1 || errs[0] != "failed load read state of random" {
+		t.Errorf("unexpected errors %v", errs)
+	}
+}
+
+func TestRefreshInBackgroundError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok": false, "error": "token_revoked"}`))
+	}))
+	defer srv.Close()
+	events.drain()
+
+	team := newTestTeam()
+	team.setClient(srv.URL + "/")
+	team.refreshInBackground()
+
+	evs := events.drain()
+	if len(evs) != 1 || evs[0].eventType != EventError || !strings.Contains(evs[0].text, "token_revoked") {
+		t.Errorf("expected refresh error event, got %+v", evs)
+	}
+}
+
+func TestLookupUnknownUsers(t *testing.T) {
+	calls := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Path + " " + r.FormValue("user") + r.FormValue("bot")
+		calls[key]++
+		switch {
+		case key == "/users.info U1" && calls[key] == 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case key == "/users.info U1":
+			w.Write([]byte(`{"ok": true, "user": {"id": "U1", "name": "alice"}}`))
+		case key == "/users.info U9":
+			w.Write([]byte(`{"ok": false, "error": "user_not_found"}`))
+		case key == "/bots.info B1" && calls[key] == 1:
+			w.WriteHeader(http.StatusBadGateway)
+		case key == "/bots.info B1":
+			w.Write([]byte(`{"ok": true, "bot": {"id": "B1", "name": "deploy"}}`))
+		default:
+			t.Errorf("unexpected call %s", key)
+		}
+	}))
+	defer srv.Close()
+
+	team := newTestTeam()
+	team.setClient(srv.URL + "/")
+
+	if u := team.lookupUser("U1"); u != nil {
+		t.Errorf("expected no user while rate limited, got %v", u)
+	}
+	if u := team.lookupUser("U1"); u == nil || u.name != "alice" {
+		t.Errorf("expected user fetched after rate limit, got %v", u)
+	}
+	team.lookupUser("U9")
+	team.lookupUser("U9")
+	if calls["/users.info U9"] != 1 {
+		t.Errorf("expected missing user fetched once, got %d", calls["/users.info U9"])
+	}
+	if name := team.lookupBot("B1"); name != "" {
+		t.Errorf("expected no bot on server error, got %s", name)
+	}
+	if name := team.lookupBot("B1"); name != "deploy" {
+		t.Errorf("expected bot fetched after server error, got %s", name)
+	}
+}
+
+// serialSpeaker records texts and whether two were spoken at once.
+type serialSpeaker struct {
+	mu      sync.Mutex
+	active  bool
+	overlap bool
+	texts   []string
+	done    chan struct{}
+}
+
+func (s *serialSpeaker) Speak(text string) error {
+	s.mu.Lock()
+	s.overlap = s.overlap || s.active
+	s.active = true
+	s.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	s.mu.Lock()
+	s.active = false
+	s.texts = append(s.texts, text)
+	s.mu.Unlock()
+	s.done <- struct{}{}
+	return nil
+}
+
+func TestSpeechQueue(t *testing.T) {
+	spk := &serialSpeaker{done: make(chan struct{}, 3)}
+	SetSpeaker(spk)
+	defer SetSpeaker(nil)
+
+	for _, text := range []string{"a", "b", "c"} {
+		speak(text)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-spk.done:
+		case <-time.After(time.Second):
+			t.Fatal("messages were not spoken")
+		}
+	}
+	spk.mu.Lock()
+	defer spk.mu.Unlock()
+	if spk.overlap || strings.Join(spk.texts, "") != "abc" {
+		t.Errorf("expected messages spoken one by one in order, got %v overlap %v", spk.texts, spk.overlap)
+	}
+}
+
+func TestRefreshRetry(t *testing.T) {
+	viper.Set("slack.cache", false)
+	defer viper.Set("slack.cache", true)
+
+	calls := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls[r.URL.Path]++
+		if calls[r.URL.Path] == 1 {
+			// every method is rate limited once
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		switch r.URL.Path {
+		case "/users.list":
+			w.Write([]byte(`{"ok": true, "members": [{"id": "U1", "name": "alice"}, {"id": "U2", "name": "bob"}]}`))
+		case "/users.prefs.get":
+			w.Write([]byte(`{"ok": true, "prefs": {"muted_channels": "C1"}}`))
+		case "/conversations.list":
+			w.Write([]byte(`{"ok": true, "channels": [
+				{"id": "C1", "name": "general", "is_channel": true, "is_member": true},
+				{"id": "G1", "name": "mpdm-alice--bob-1", "is_mpim": true}
+			]}`))
+		case "/conversations.members":
+			w.Write([]byte(`{"ok": true, "members": ["U0", "U1", "U2"]}`))
+		default:
+			t.Errorf("unexpected call %s", r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+
+	team := newTestTeam()
+	team.userID = "U0"
+	team.setClient(srv.URL + "/")
+	if err := team.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if c := team.channel("@alice,@bob"); c == nil {
+		t.Errorf("expected mpim named after members, got %v", team.SortedChannels())
+	}
+	if c := team.channel("general"); c == nil || !c.channelInfo().muted {
+		t.Error("expected muted general")
+	}
+	if calls["/conversations.members"] != 2 || calls["/users.prefs.get"] != 2 {
+		t.Errorf("unexpected calls %v", calls)
+	}
+}
+
+func TestRefreshMergesChannels(t *testing.T) {
+	viper.Set("slack.cache", false)
+	defer viper.Set("slack.cache", true)
+
+	team := newTestTeam()
+	team.userID = "U0"
+	team.addChannel(&Channel{id: "C9", name: "left"})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/users.list":
+			w.Write([]byte(`{"ok": true, "members": [{"id": "U1", "name": "alice"}]}`))
+		case "/users.prefs.get":
+			w.Write([]byte(`{"ok": true, "prefs": {}}`))
+		case "/conversations.list":
+			// joined while the list is fetched
+			ch := &slack.Channel{}
+			ch.ID = "C2"
+			ch.Name = "random"
+			team.joinChannel(ch)
+			w.Write([]byte(`{"ok": true, "channels": [{"id": "C1", "name": "general", "is_channel": true, "is_member": true}]}`))
+		default:
+			t.Errorf("unexpected call %s", r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+
+	team.setClient(srv.URL + "/")
+	if err := team.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if team.channel("general") == nil || team.channel("random") == nil {
+		t.Errorf("expected fetched and joined channels, got %v", team.SortedChannels())
+	}
+	if team.channel("left") != nil {
+		t.Error("expected channel missing from the refresh removed")
+	}
+}
+
+func TestRenameChannel(t *testing.T) {
+	viper.Set("slack.cache", false)
+	defer viper.Set("slack.cache", true)
+
+	team := newTestTeam()
+	old := &Channel{id: "C1", name: "general"}
+	old.markRead("1.0")
+	team.addChannel(old)
+	team.renameChannel("C1", "lobby")
+
+	c := team.channel("lobby")
+	if c == nil || c == old || team.channel("general") != nil {
+		t.Fatalf("expected renamed copy registered, got %v", team.SortedChannels())
+	}
+	if old.name != "general" {
+		t.Errorf("expected held channel unchanged, got %s", old.name)
+	}
+	if c.readState() != old.readState() {
+		t.Errorf("expected read state kept, got %+v", c.readState())
+	}
+}
@@ -0,0 +1,133 @@
+package slack
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+	"github.com/slack-go/slack/socketmode"
+)
+
+const (
+	socketModeMinBackoff = time.Second
+	socketModeMaxBackoff = 5 * time.Minute
+)
+
+// StartSocketMode receives events with Socket Mode and passes them to callback
+// like StartRTM. It blocks until Stop cancels ctx.
+func (t *Team) StartSocketMode(ctx context.Context, callback RTMCallback) {
+	api := slack.New(t.token, slack.OptionAppLevelToken(t.appToken), slack.OptionAPIURL(t.apiURL))
+	smc := socketmode.New(api)
+
+	go t.runSocketMode(ctx, smc, callback)
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Debug().Msgf("disconnected team [%s]", t.name)
+			return
+		case ev := <-smc.Events:
+			if !t.handleSocketModeEvent(smc, ev, callback) {
+				return
+			}
+		}
+	}
+}
+
+// runSocketMode keeps the connection running and reconnects with backoff
+// when socketmode gives up.
+func (t *Team) runSocketMode(ctx context.Context, smc *socketmode.Client, callback RTMCallback) {
+	backoff := socketModeMinBackoff
+	for {
+		start := time.Now()
+		err := smc.RunContext(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Debug().Msgf("socket mode connection failed: %s", err)
+			callback(t.newEvent(EventError, err.Error()))
+		}
+		if time.Since(start) > socketModeMaxBackoff {
+			backoff = socketModeMinBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > socketModeMaxBackoff {
+			backoff = socketModeMaxBackoff
+		}
+	}
+}
+
+func (t *Team) handleSocketModeEvent(smc *socketmode.Client, ev socketmode.Event, callback RTMCallback) bool {
+	switch ev.Type {
+	case socketmode.EventTypeHello:
+		return t.handleEvent(&slack.HelloEvent{}, callback)
+	case socketmode.EventTypeConnected:
+		if data, ok := ev.Data.(*socketmode.ConnectedEvent); ok {
+			log.Debug().Msgf("Connection counter:%v", data.ConnectionCount)
+		}
+		callback(t.newEvent(EventConnected, "connected"))
+	case socketmode.EventTypeConnectionError:
+		if data, ok := ev.Data.(*slack.ConnectionErrorEvent); ok {
+			return t.handleEvent(&slack.RTMError{Msg: data.Error()}, callback)
+		}
+	case socketmode.EventTypeInvalidAuth:
+		return t.handleEvent(&slack.InvalidAuthEvent{}, callback)
+	case socketmode.EventTypeEventsAPI:
+		if ev.Request == nil {
+			return true
+		}
+		smc.Ack(*ev.Request)
+		data, err := decodeInnerEvent(ev.Request.Payload)
+		if err != nil {
+			log.Debug().Msgf("failed decode socket mode event: %s", err)
+			return true
+		}
+		if data != nil {
+			return t.handleEvent(data, callback)
+		}
+	case socketmode.EventTypeInteractive, socketmode.EventTypeSlashCommand:
+		if ev.Request != nil {
+			smc.Ack(*ev.Request)
+		}
+	}
+	return true
+}
+
+// decodeInnerEvent decodes the inner event of an Events API payload into
+// the same struct RTM uses for the event type.
+// It returns nil for event types RTM does not know.
+func decodeInnerEvent(payload json.RawMessage) (interface{}, error) {
+	var outer slackevents.EventsAPICallbackEvent
+	if err := json.Unmarshal(payload, &outer); err != nil {
+		return nil, err
+	}
+	if outer.InnerEvent == nil {
+		return nil, nil
+	}
+
+	var inner struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(*outer.InnerEvent, &inner); err != nil {
+		return nil, err
+	}
+	v, ok := slack.EventMapping[inner.Type]
+	if !ok {
+		return nil, nil
+	}
+	data := reflect.New(reflect.TypeOf(v)).Interface()
+	if err := json.Unmarshal(*outer.InnerEvent, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
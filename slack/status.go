@@ -0,0 +1,219 @@
+package slack
+
+import (
+	"strings"
+	"time"
+
+	"github.com/mopemope/emacs-module-go"
+	"github.com/pkg/errors"
+	"github.com/slack-go/slack"
+)
+
+// presence values of SetPresence
+const (
+	PresenceAuto = "auto"
+	PresenceAway = "away"
+)
+
+type presenceEvent struct {
+	userID   string
+	user     string
+	presence string
+}
+
+type dndEvent struct {
+	userID        string
+	user          string
+	enabled       bool
+	snoozeEnabled bool
+	snoozeEnd     int
+}
+
+func SetStatus(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	text, err := optString(env, ctx.Arg(1))
+	if err != nil {
+		return env.StdLib().Nil(), errors.Wrap(err, "")
+	}
+	emoji, err := optString(env, ctx.Arg(2))
+	if err != nil {
+		return env.StdLib().Nil(), errors.Wrap(err, "")
+	}
+	var expiration time.Time
+	if minutes := optInt(env, ctx.Arg(3), 0); minutes > 0 {
+		expiration = time.Now().Add(time.Duration(minutes) * time.Minute)
+	}
+	return eachTeam(ctx, func(team *Team) error {
+		return team.SetStatus(text, emoji, expiration)
+	})
+}
+
+func ClearStatus(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	return eachTeam(ctx, func(team *Team) error {
+		return team.ClearStatus()
+	})
+}
+
+func SetPresence(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	presence, err := symbolName(env, ctx.Arg(1))
+	if err != nil {
+		return env.StdLib().Nil(), errors.Wrap(err, "")
+	}
+	return eachTeam(ctx, func(team *Team) error {
+		return team.SetPresence(presence)
+	})
+}
+
+func SetSnooze(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	minutes := optInt(env, ctx.Arg(1), 0)
+	return eachTeam(ctx, func(team *Team) error {
+		return team.SetSnooze(minutes)
+	})
+}
+
+func EndSnooze(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	return eachTeam(ctx, func(team *Team) error {
+		return team.EndSnooze()
+	})
+}
+
+// eachTeam calls fn for the team of the first argument, or all teams when it is nil.
+// It returns the names of the teams.
+func eachTeam(ctx emacs.FunctionCallContext, fn func(*Team) error) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	targets, err := targetTeams(env, ctx.Arg(0))
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	var items []emacs.Value
+	for _, team := range targets {
+		if err := fn(team); err != nil {
+			return stdlib.Nil(), errors.Wrapf(err, "team %s", team.name)
+		}
+		items = append(items, env.String(team.name))
+	}
+	return stdlib.List(items...), nil
+}
+
+// SetStatus sets the custom status. A zero expiration never expires.
+func (t *Team) SetStatus(text string, emoji string, expiration time.Time) error {
+	if err := t.online(); err != nil {
+		return err
+	}
+	if emoji != "" {
+		emoji = ":" + strings.Trim(emoji, ":") + ":"
+	}
+	var exp int64
+	if !expiration.IsZero() {
+		exp = expiration.Unix()
+	}
+	if err := t.client.SetUserCustomStatus(text, emoji, exp); err != nil {
+		return errors.Wrap(err, "failed set status")
+	}
+	return nil
+}
+
+func (t *Team) ClearStatus() error {
+	if err := t.online(); err != nil {
+		return err
+	}
+	if err := t.client.UnsetUserCustomStatus(); err != nil {
+		return errors.Wrap(err, "failed clear status")
+	}
+	return nil
+}
+
+// SetPresence sets the presence to auto or away.
+func (t *Team) SetPresence(presence string) error {
+	if err := t.online(); err != nil {
+		return err
+	}
+	if presence != PresenceAuto && presence != PresenceAway {
+		return errors.Errorf("unknown presence %s", presence)
+	}
+	if err := t.client.SetUserPresence(presence); err != nil {
+		return errors.Wrap(err, "failed set presence")
+	}
+	return nil
+}
+
+// SetSnooze turns on Do Not Disturb for minutes.
+func (t *Team) SetSnooze(minutes int) error {
+	if err := t.online(); err != nil {
+		return err
+	}
+	if minutes <= 0 {
+		return errors.Errorf("invalid snooze minutes %d", minutes)
+	}
+	if _, err := t.client.SetSnooze(minutes); err != nil {
+		return errors.Wrap(err, "failed set snooze")
+	}
+	return nil
+}
+
+func (t *Team) EndSnooze() error {
+	if err := t.online(); err != nil {
+		return err
+	}
+	if _, err := t.client.EndSnooze(); err != nil {
+		return errors.Wrap(err, "failed end snooze")
+	}
+	return nil
+}
+
+// presenceUsers returns the counterpart users of direct messages,
+// whose presence changes are subscribed with RTM.
+func (t *Team) presenceUsers() []string {
+	seen := map[string]bool{}
+	var ids []string
+	for _, c := range t.GetChannels() {
+		if !c.isIM {
+			continue
+		}
+		for _, id := range c.userIDs {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// newPresenceEvents returns an event for each user of a presence change.
+func (t *Team) newPresenceEvents(ev *slack.PresenceChangeEvent) []*Event {
+	ids := ev.Users
+	if ev.User != "" {
+		ids = append([]string{ev.User}, ids...)
+	}
+	var res []*Event
+	for _, id := range ids {
+		res = append(res, &Event{
+			eventType: EventPresenceChange,
+			teamName:  t.name,
+			presence: &presenceEvent{
+				userID:   id,
+				user:     t.userName(id),
+				presence: ev.Presence,
+			},
+		})
+	}
+	return res
+}
+
+func (t *Team) newDNDEvent(ev *slack.DNDUpdatedEvent) *Event {
+	return &Event{
+		eventType: EventDNDUpdated,
+		teamName:  t.name,
+		dnd: &dndEvent{
+			userID:        ev.User,
+			user:          t.userName(ev.User),
+			enabled:       ev.Status.Enabled,
+			snoozeEnabled: ev.Status.SnoozeEnabled,
+			snoozeEnd:     ev.Status.SnoozeEndTime,
+		},
+	}
+}
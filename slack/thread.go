@@ -0,0 +1,78 @@
+package slack
+
+import (
+	"github.com/mopemope/emacs-module-go"
+	"github.com/pkg/errors"
+	"github.com/slack-go/slack"
+)
+
+func GetThread(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	teamName, err := ctx.GoStringArg(0)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	channelName, err := ctx.GoStringArg(1)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	threadTS, err := optString(env, ctx.Arg(2))
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+
+	msgs, err := GetConversationReplies(teamName, channelName, threadTS)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+
+	var items []emacs.Value
+	for _, m := range msgs {
+		items = append(items, m.toPlist(env))
+	}
+	return stdlib.List(items...), nil
+}
+
+// GetConversationReplies returns the parent message and all replies of the thread.
+func GetConversationReplies(teamName string, channelName string, threadTS string) ([]*Message, error) {
+	team, channel := findChannel(teamName, channelName)
+	if channel == nil {
+		return nil, errors.Errorf("failed find channel %s", channelName)
+	}
+
+	if team.export != nil {
+		return team.exportReplies(channel, threadTS)
+	}
+
+	var msgs []*Message
+	nextCur := ""
+	for {
+		var replies []slack.Message
+		var hasMore bool
+		var cursor string
+		err := team.retryNow("conversations.replies", true, func() error {
+			var err error
+			replies, hasMore, cursor, err = team.client.GetConversationReplies(&slack.GetConversationRepliesParameters{
+				ChannelID: channel.id,
+				Timestamp: threadTS,
+				Cursor:    nextCur,
+				Limit:     historyPageSize,
+			})
+			return err
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed get conversation replies")
+		}
+
+		for i := range replies {
+			msgs = append(msgs, team.newMessage(channel.id, &replies[i].Msg))
+		}
+		if !hasMore || cursor == "" {
+			break
+		}
+		nextCur = cursor
+	}
+	team.archiveMessages(channel.id, msgs...)
+	return msgs, nil
+}
@@ -0,0 +1,188 @@
+package slack
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mopemope/emacs-module-go"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/slack-go/slack"
+)
+
+// readState is the read state of a member channel.
+type readState struct {
+	lastRead    string
+	latest      string
+	unreadCount int
+}
+
+func GetUnreads(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	targets, err := targetTeams(env, ctx.Arg(0))
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+
+	var items []emacs.Value
+	for _, team := range targets {
+		for _, c := range team.GetChannels() {
+			rs := c.readState()
+			items = append(items, plist(env,
+				":team", team.name,
+				":channel", c.name,
+				":unread-count", rs.unreadCount,
+				":last-read", rs.lastRead,
+				":latest", rs.latest,
+			))
+		}
+	}
+	return stdlib.List(items...), nil
+}
+
+func MarkRead(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	team, channel, ts, err := messageRefArgs(ctx)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	if err := team.MarkRead(channel, ts); err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	return stdlib.T(), nil
+}
+
+// MarkRead moves the read cursor of the channel to ts, or to the latest message when ts is empty.
+func (t *Team) MarkRead(channelName string, ts string) error {
+	if err := t.online(); err != nil {
+		return err
+	}
+	c := t.channel(channelName)
+	if c == nil {
+		return errors.Errorf("failed find channel %s", channelName)
+	}
+	if ts == "" {
+		ts = c.readState().latest
+	}
+	if ts == "" {
+		return nil
+	}
+	if err := t.client.MarkConversation(c.id, ts); err != nil {
+		return errors.Wrap(err, "failed mark conversation")
+	}
+	c.markRead(ts)
+	return nil
+}
+
+// loadReadStates fetches the read state of member channels with conversations.info.
+// It is run in background because it calls the api for each channel, waiting
+// for rate limits, and channels that still fail are reported as an error event.
+func (t *Team) loadReadStates() {
+	var failed []string
+	for _, c := range t.GetChannels() {
+		var info *slack.Channel
+		err := t.retry("conversations.info", true, func() error {
+			var err error
+			info, err = t.client.GetConversationInfo(&slack.GetConversationInfoInput{ChannelID: c.id})
+			return err
+		})
+		if err != nil {
+			log.Debug().Msgf("failed get conversation info %s: %s", c.name, err)
+			failed = append(failed, c.name)
+			continue
+		}
+		c.mu.Lock()
+		c.read.lastRead = info.LastRead
+		c.read.unreadCount = info.UnreadCountDisplay
+		if info.Latest != nil && tsAfter(info.Latest.Timestamp, c.read.latest) {
+			c.read.latest = info.Latest.Timestamp
+		}
+		c.mu.Unlock()
+	}
+	if len(failed) > 0 {
+		events.push(t.newEvent(EventError, fmt.Sprintf("failed load read state of %s", strings.Join(failed, ", "))))
+	}
+}
+
+// trackUnread updates the read state with a new message.
+func (t *Team) trackUnread(ev *slack.MessageEvent) {
+	if ev.SubType != "" && ev.SubType != "bot_message" && ev.SubType != "file_share" && ev.SubType != "thread_broadcast" {
+		return
+	}
+	if ev.ThreadTimestamp != "" && ev.ThreadTimestamp != ev.Timestamp && ev.SubType != "thread_broadcast" {
+		// replies are not counted as channel unreads
+		return
+	}
+	c := t.channelByID(ev.Channel)
+	if c == nil {
+		return
+	}
+	if ev.User != "" && ev.User == t.userID {
+		c.markRead(ev.Timestamp)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if tsAfter(ev.Timestamp, c.read.latest) {
+		c.read.latest = ev.Timestamp
+	}
+	if tsAfter(ev.Timestamp, c.read.lastRead) {
+		c.read.unreadCount++
+	}
+}
+
+// trackMarked updates the read state when the channel is marked on another client.
+func (t *Team) trackMarked(channelID string, ts string) {
+	if c := t.channelByID(channelID); c != nil {
+		c.markRead(ts)
+	}
+}
+
+func (c *Channel) readState() readState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.read
+}
+
+func (c *Channel) markRead(ts string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !tsAfter(ts, c.read.lastRead) {
+		return
+	}
+	c.read.lastRead = ts
+	if tsAfter(ts, c.read.latest) {
+		c.read.latest = ts
+	}
+	if !tsAfter(c.read.latest, ts) {
+		c.read.unreadCount = 0
+	}
+}
+
+// tsAfter reports whether slack timestamp a is later than b.
+func tsAfter(a string, b string) bool {
+	if b == "" {
+		return a != ""
+	}
+	as, af := splitTS(a)
+	bs, bf := splitTS(b)
+	if as != bs {
+		return as > bs
+	}
+	return af > bf
+}
+
+func splitTS(ts string) (int64, int64) {
+	sec, frac := ts, ""
+	if i := strings.Index(ts, "."); i >= 0 {
+		sec, frac = ts[:i], ts[i+1:]
+	}
+	s, _ := strconv.ParseInt(sec, 10, 64)
+	frac = (frac + "000000")[:6]
+	f, _ := strconv.ParseInt(frac, 10, 64)
+	return s, f
+}
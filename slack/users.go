@@ -0,0 +1,264 @@
+package slack
+
+import (
+	"sort"
+	"time"
+
+	"github.com/mopemope/emacs-module-go"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/slack-go/slack"
+)
+
+func GetUsers(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	team, err := teamArg(ctx)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	now := time.Now()
+	var items []emacs.Value
+	for _, u := range team.SortedUsers() {
+		items = append(items, u.toPlist(env, now))
+	}
+	return stdlib.List(items...), nil
+}
+
+func GetUserInfo(ctx emacs.FunctionCallContext) (emacs.Value, error) {
+	env := ctx.Environment()
+	stdlib := env.StdLib()
+	team, err := teamArg(ctx)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	name, err := ctx.GoStringArg(1)
+	if err != nil {
+		return stdlib.Nil(), errors.Wrap(err, "")
+	}
+	u := team.findUser(name)
+	if u == nil {
+		u = team.lookupUser(name)
+	}
+	if u == nil {
+		return stdlib.Nil(), errors.Errorf("failed find user %s", name)
+	}
+	return u.toPlist(env, time.Now()), nil
+}
+
+// SortedUsers returns the users ordered by name.
+func (t *Team) SortedUsers() []*User {
+	t.umu.RLock()
+	var users []*User
+	for _, u := range t.users {
+		users = append(users, u)
+	}
+	t.umu.RUnlock()
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].name != users[j].name {
+			return users[i].name < users[j].name
+		}
+		return users[i].id < users[j].id
+	})
+	return users
+}
+
+// localTime returns now in the timezone of the user.
+func (u *User) localTime(now time.Time) time.Time {
+	if u.tz != "" {
+		if loc, err := time.LoadLocation(u.tz); err == nil {
+			return now.In(loc)
+		}
+	}
+	return now.In(time.FixedZone(u.tz, u.tzOffset))
+}
+
+func (u *User) toPlist(env emacs.Environment, now time.Time) emacs.Value {
+	return plist(env,
+		":id", u.id,
+		":name", u.name,
+		":handle", u.handle,
+		":display-name", u.displayName,
+		":real-name", u.realName,
+		":title", u.title,
+		":email", u.email,
+		":tz", u.tz,
+		":tz-offset", u.tzOffset,
+		":local-time", u.localTime(now).Format("2006-01-02 15:04 MST"),
+		":is-bot", u.isBot,
+		":deleted", u.deleted,
+		":avatar", u.avatar,
+	)
+}
+
+// userName returns the user name, or the id when the user is unknown.
+func (t *Team) userName(id string) string {
+	if u := t.lookupUser(id); u != nil {
+		return u.name
+	}
+	return id
+}
+
+func (t *Team) user(id string) *User {
+	t.umu.RLock()
+	defer t.umu.RUnlock()
+	return t.users[id]
+}
+
+func (t *Team) addUser(u *User) {
+	t.umu.Lock()
+	defer t.umu.Unlock()
+	t.users[u.id] = u
+	delete(t.unknown, u.id)
+}
+
+// lookupUser returns the user, fetching users unknown to the team with users.info.
+// Users slack does not find are remembered and not fetched again. Other failures
+// such as rate limits are not, so the user is fetched on the next lookup.
+func (t *Team) lookupUser(id string) *User {
+	if u := t.user(id); u != nil {
+		return u
+	}
+	if t.client == nil || id == "" || t.isUnknown(id) {
+		return nil
+	}
+	info, err := t.client.GetUserInfo(id)
+	if err != nil {
+		log.Debug().Msgf("failed get user info %s: %s", id, err)
+		if notFound(err) {
+			t.setUnknown(id)
+		}
+		return nil
+	}
+	u := newUser(info)
+	t.addUser(u)
+	return u
+}
+
+// lookupBot returns the bot name, fetching it with bots.info.
+// It returns an empty string when the bot is unknown.
+func (t *Team) lookupBot(id string) string {
+	t.umu.RLock()
+	name, ok := t.bots[id]
+	t.umu.RUnlock()
+	if ok {
+		return name
+	}
+	if t.client == nil || id == "" || t.isUnknown(id) {
+		return ""
+	}
+	bot, err := t.client.GetBotInfo(id)
+	if err != nil {
+		log.Debug().Msgf("failed get bot info %s: %s", id, err)
+		if notFound(err) {
+			t.setUnknown(id)
+		}
+		return ""
+	}
+	t.addBot(id, bot.Name)
+	return bot.Name
+}
+
+// notFound reports whether the error says the user or bot does not exist.
+func notFound(err error) bool {
+	if e, ok := errors.Cause(err).(slack.SlackErrorResponse); ok {
+		switch e.Err {
+		case "user_not_found", "user_not_visible", "bot_not_found":
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Team) addBot(id string, name string) {
+	t.umu.Lock()
+	defer t.umu.Unlock()
+	if t.bots == nil {
+		t.bots = map[string]string{}
+	}
+	t.bots[id] = name
+}
+
+func (t *Team) isUnknown(id string) bool {
+	t.umu.RLock()
+	defer t.umu.RUnlock()
+	return t.unknown[id]
+}
+
+func (t *Team) setUnknown(id string) {
+	t.umu.Lock()
+	defer t.umu.Unlock()
+	if t.unknown == nil {
+		t.unknown = map[string]bool{}
+	}
+	t.unknown[id] = true
+}
+
+// messageUser returns the id and name of the sender of the message.
+// Messages of bots, apps and integrations may have no user, and
+// users of other organizations may be unknown to users.info.
+func (t *Team) messageUser(m *slack.Msg) (string, string) {
+	if m.User != "" {
+		if u := t.lookupUser(m.User); u != nil {
+			return u.id, u.name
+		}
+		if m.Username != "" {
+			return m.User, m.Username
+		}
+		return m.User, m.User
+	}
+	switch {
+	case m.BotProfile != nil && m.BotProfile.Name != "":
+		return m.BotID, m.BotProfile.Name
+	case m.Username != "":
+		return m.BotID, m.Username
+	case m.BotID != "":
+		if name := t.lookupBot(m.BotID); name != "" {
+			return m.BotID, name
+		}
+		return m.BotID, m.BotID
+	}
+	return "", ""
+}
+
+func newUser(u *slack.User) *User {
+	return &User{
+		id:          u.ID,
+		name:        userDisplayName(u),
+		handle:      u.Name,
+		displayName: u.Profile.DisplayName,
+		realName:    u.RealName,
+		title:       u.Profile.Title,
+		email:       u.Profile.Email,
+		tz:          u.TZ,
+		tzOffset:    u.TZOffset,
+		isBot:       u.IsBot,
+		deleted:     u.Deleted,
+		avatar:      u.Profile.Image192,
+	}
+}
+
+// names returns the names the user is referred to by, the name first.
+func (u *User) names() []string {
+	var res []string
+	for _, name := range []string{u.name, u.handle, u.displayName, u.realName} {
+		if name == "" {
+			continue
+		}
+		dup := false
+		for _, n := range res {
+			dup = dup || n == name
+		}
+		if !dup {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+func userDisplayName(u *slack.User) string {
+	if u.RealName != "" {
+		return u.RealName
+	}
+	return u.Name
+}
@@ -57,6 +57,11 @@ func (s *Speaker) Speech(ectx emacs.FunctionCallContext) (emacs.Value, error) {
 	return stdlib.T(), nil
 }
 
+// Speak reads the text aloud.
+func (s *Speaker) Speak(text string) error {
+	return s.speech(context.Background(), text)
+}
+
 func (s *Speaker) speech(ctx context.Context, text string) error {
 	if text == "" {
 		return nil